@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// authorizer adds credentials to a status request.
+type authorizer func(req *http.Request) error
+
+// authorizers holds a constructor for every -nginx.auth mode this binary
+// was built with. Modes needing extra libraries register themselves from
+// files behind a build tag, e.g. negotiate with -tags spnego.
+var authorizers = map[string]func() (authorizer, error){}
+
+// newAuthorizer returns the authorizer of the -nginx.auth mode, nil if no
+// authentication is configured.
+func newAuthorizer(mode string) (authorizer, error) {
+	if mode == "" {
+		return nil, nil
+	}
+	newAuth, ok := authorizers[mode]
+	if !ok {
+		if mode == "negotiate" {
+			return nil, fmt.Errorf("-nginx.auth=negotiate requires building with -tags spnego")
+		}
+		return nil, fmt.Errorf("unknown -nginx.auth mode %q", mode)
+	}
+	return newAuth()
+}
@@ -0,0 +1,46 @@
+//go:build spnego
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+func init() {
+	authorizers["negotiate"] = func() (authorizer, error) {
+		return newNegotiateAuthorizer(*keytabPath, *krb5Principal, *krb5Config)
+	}
+}
+
+// newNegotiateAuthorizer logs in as principal, given as user@REALM, with the
+// keytab and returns an authorizer adding an "Authorization: Negotiate"
+// header for the HTTP service of the request's host. The client renews its
+// tickets on its own, so the login happens once.
+func newNegotiateAuthorizer(keytabPath, principal, krb5Config string) (authorizer, error) {
+	i := strings.LastIndex(principal, "@")
+	if i <= 0 || i == len(principal)-1 {
+		return nil, fmt.Errorf("invalid -nginx.krb5-principal %q, must be user@REALM", principal)
+	}
+	kt, err := keytab.Load(keytabPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading keytab: %s", err)
+	}
+	cfg, err := config.Load(krb5Config)
+	if err != nil {
+		return nil, fmt.Errorf("error loading kerberos config: %s", err)
+	}
+	cl := client.NewWithKeytab(principal[:i], principal[i+1:], kt, cfg, client.DisablePAFXFAST(true))
+	if err := cl.Login(); err != nil {
+		return nil, fmt.Errorf("kerberos login as %s failed: %s", principal, err)
+	}
+	return func(req *http.Request) error {
+		return spnego.SetSPNEGOHeader(cl, req, "")
+	}, nil
+}
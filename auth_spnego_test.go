@@ -0,0 +1,70 @@
+//go:build spnego
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestNegotiateAuth needs a KDC: set NGINX_EXPORTER_TEST_KRB5_CONFIG,
+// NGINX_EXPORTER_TEST_KEYTAB and NGINX_EXPORTER_TEST_PRINCIPAL for the
+// client, and NGINX_EXPORTER_TEST_SERVICE_KEYTAB holding the key of
+// HTTP/127.0.0.1.
+func TestNegotiateAuth(t *testing.T) {
+	env := map[string]string{}
+	for _, name := range []string{"KRB5_CONFIG", "KEYTAB", "PRINCIPAL", "SERVICE_KEYTAB"} {
+		env[name] = os.Getenv("NGINX_EXPORTER_TEST_" + name)
+		if env[name] == "" {
+			t.Skip("kerberos test environment not configured")
+		}
+	}
+	serviceKeytab, err := keytab.Load(env["SERVICE_KEYTAB"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var authenticated bool
+	h := spnego.SPNEGOKRB5Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated = true
+		fmt.Fprint(w, nginxStatus)
+	}), serviceKeytab)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	authorize, err := newNegotiateAuthorizer(env["KEYTAB"], env["PRINCIPAL"], env["KRB5_CONFIG"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExporter(server.URL)
+	e.authorize = authorize
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_up"); v != 1 || !authenticated {
+		t.Errorf("expected an authenticated scrape, got nginx_up %v", v)
+	}
+}
+
+func TestNegotiateAuthRejected(t *testing.T) {
+	kt := keytab.New()
+	server := httptest.NewServer(spnego.SPNEGOKRB5Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unauthenticated request reached the handler")
+	}), kt))
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_up"); v != 0 {
+		t.Errorf("expected nginx_up 0 without a Negotiate token, got %v", v)
+	}
+}
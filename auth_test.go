@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAuthorizer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Negotiate dG9rZW4=" {
+			w.Header().Set("WWW-Authenticate", "Negotiate")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, nginxStatus)
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		authorize authorizer
+		up        float64
+	}{
+		{nil, 0},
+		{func(req *http.Request) error {
+			req.Header.Set("Authorization", "Negotiate dG9rZW4=")
+			return nil
+		}, 1},
+		{func(*http.Request) error { return errors.New("no ticket") }, 0},
+	} {
+		e := NewExporter(server.URL)
+		e.authorize = test.authorize
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(e)
+		if v, _ := seriesValue(gather(t, reg), "nginx_up"); v != test.up {
+			t.Errorf("expected nginx_up %v, got %v", test.up, v)
+		}
+	}
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	if a, err := newAuthorizer(""); a != nil || err != nil {
+		t.Errorf("expected no authorizer without -nginx.auth, got %v", err)
+	}
+	if _, err := newAuthorizer("basic"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+	if _, ok := authorizers["negotiate"]; !ok {
+		if _, err := newAuthorizer("negotiate"); err == nil {
+			t.Error("expected an error for negotiate without -tags spnego")
+		}
+	}
+}
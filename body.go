@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// bufferPool holds the buffers status bodies are read into, so that
+// frequent scrapes don't allocate a fresh, growing buffer each time.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// maxPooledBuffer is the capacity above which a buffer is dropped rather
+// than pooled, so that a single huge body doesn't stay resident.
+const maxPooledBuffer = 1 << 20
+
+// putBuffer returns buf to the pool. buf must not be used afterwards, nor
+// any slice of its contents.
+func putBuffer(buf *bytes.Buffer) {
+	if buf != nil && buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// decoders holds the content encodings status bodies can be decompressed
+// from. Encodings needing extra libraries register themselves from files
+// behind a build tag, e.g. br with -tags brotli.
+var decoders = map[string]func(r io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+}
+
+// acceptEncoding returns the Accept-Encoding header listing the decoders.
+func acceptEncoding() string {
+	var encodings []string
+	for enc := range decoders {
+		encodings = append(encodings, enc)
+	}
+	sort.Strings(encodings)
+	return strings.Join(encodings, ", ")
+}
+
+// errBodyLimit is returned for status bodies longer than -nginx.max-body-bytes.
+var errBodyLimit = errors.New("status body exceeds -nginx.max-body-bytes")
+
+// errBodyCut is returned with the leading bytes of a status body longer
+// than the part of it kept to parse under -nginx.max-scrape-memory.
+var errBodyCut = errors.New("status body exceeds -nginx.max-scrape-memory")
+
+// readBody reads the body of resp into a pooled buffer, decompressing it if
+// it is encoded with one of the decoders. compressed is the size of the body
+// as received, 0 if it wasn't encoded. If limit is positive, it reads at
+// most limit bytes of the decompressed body, returning errBodyLimit if there
+// are more. If keep is positive and less than limit, it keeps at most keep
+// bytes, returning errBodyCut along with them if there are more but no more
+// than limit. The caller returns the buffer with putBuffer.
+func readBody(resp *http.Response, limit, keep int64) (buf *bytes.Buffer, compressed int, err error) {
+	buf = getBuffer()
+	var (
+		r io.Reader = resp.Body
+		c *countingReader
+	)
+	if decode, ok := decoders[resp.Header.Get("Content-Encoding")]; ok {
+		c = &countingReader{r: resp.Body}
+		if r, err = decode(c); err != nil {
+			return buf, 0, err
+		}
+	}
+	if keep <= 0 || (limit > 0 && keep >= limit) {
+		keep = limit
+	}
+	if keep <= 0 {
+		_, err = buf.ReadFrom(r)
+	} else {
+		// The byte past keep tells a body of exactly keep bytes from a
+		// longer one.
+		_, err = buf.ReadFrom(io.LimitReader(r, keep+1))
+	}
+	if keep > 0 && int64(buf.Len()) > keep {
+		read := int64(buf.Len())
+		buf.Truncate(int(keep))
+		if err == nil && keep < limit {
+			// Read on to the byte past the limit, discarding what
+			// isn't kept, so that a body over it still fails.
+			var n int64
+			n, err = io.Copy(ioutil.Discard, io.LimitReader(r, limit+1-read))
+			read += n
+		}
+		if err == nil {
+			err = errBodyCut
+			if limit > 0 && read > limit {
+				err = errBodyLimit
+			}
+		}
+	}
+	if c != nil {
+		compressed = c.n
+	}
+	return buf, compressed, err
+}
+
+// lineOverhead estimates the memory parsing a status line takes beyond the
+// line itself: its columns and the resulting ServerStatus.
+const lineOverhead = 256
+
+// capBody returns the leading lines of data that parsing is projected to fit
+// in limit bytes, and whether lines were cut. The projection counts data
+// twice, as the parsers copy it into a string, and lineOverhead per line.
+func capBody(data []byte, limit int64) ([]byte, bool) {
+	lines := int64(bytes.Count(data, []byte("\n")) + 1)
+	if 2*int64(len(data))+lines*lineOverhead <= limit {
+		return data, false
+	}
+	// Cut at a line end, each line taking twice its length and the
+	// overhead.
+	budget := limit
+	end := 0
+	for end < len(data) {
+		next := bytes.IndexByte(data[end:], '\n') + 1
+		if next == 0 {
+			next = len(data) - end
+		}
+		if budget -= 2*int64(next) + lineOverhead; budget < 0 {
+			break
+		}
+		end += next
+	}
+	return data[:end], true
+}
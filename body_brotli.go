@@ -0,0 +1,13 @@
+//go:build brotli
+
+package main
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+func init() {
+	decoders["br"] = func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil }
+}
@@ -0,0 +1,42 @@
+//go:build brotli
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestBrotliBody(t *testing.T) {
+	var compressed bytes.Buffer
+	bw := brotli.NewWriter(&compressed)
+	bw.Write([]byte(nginxStatus))
+	bw.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "br") {
+			t.Errorf("br missing from Accept-Encoding %q", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.gzip = true
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_upstream_servers", "upstream", "us2"); v != 3 {
+		t.Errorf("brotli body not parsed, got %v us2 servers", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_exporter_response_decompression_ratio"); v <= 1 {
+		t.Errorf("got decompression ratio %v, want above 1", v)
+	}
+}
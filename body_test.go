@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDecompressionRatio(t *testing.T) {
+	body := strings.Repeat(nginxStatus, 20)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			t.Errorf("unexpected Accept-Encoding %q", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.gzip = true
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+
+	want := float64(len(body)) / float64(compressed.Len())
+	if v, _ := seriesValue(mfs, "nginx_exporter_response_decompression_ratio"); v != want || v < 10 {
+		t.Errorf("got decompression ratio %v, want %v", v, want)
+	}
+	if v, _ := seriesValue(mfs, "nginx_upstream_servers", "upstream", "us2"); v != 60 {
+		t.Errorf("decompressed body not parsed, got %v us2 servers", v)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(nginxStatus))
+	}))
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.retries = 2
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	e.maxBody = int64(len(nginxStatus))
+	mfs := gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_up"); v != 1 {
+		t.Errorf("got nginx_up %v for a body at the limit, want 1", v)
+	}
+	if v, ok := seriesValue(mfs, "nginx_exporter_body_limit_hits_total"); !ok || v != 0 {
+		t.Errorf("got %v limit hits for a body at the limit, want 0", v)
+	}
+
+	e.maxBody = 16
+	requests = 0
+	mfs = gather(t, reg)
+	if requests != 1 {
+		t.Errorf("got %d requests for a body over the limit, want 1", requests)
+	}
+	for _, name := range []string{"nginx_exporter_scrape_retries_total", "nginx_exporter_scrape_retry_exhausted_total"} {
+		if v, _ := seriesValue(mfs, name); v != 0 {
+			t.Errorf("got %s %v for a body over the limit, want 0", name, v)
+		}
+	}
+	if v, _ := seriesValue(mfs, "nginx_up"); v != 0 {
+		t.Errorf("got nginx_up %v for a body over the limit, want 0", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_exporter_body_limit_hits_total"); v != 1 {
+		t.Errorf("got %v limit hits, want 1", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_exporter_content_length_mismatch"); v != 0 {
+		t.Errorf("got content length mismatch %v for an unread body, want 0", v)
+	}
+
+	// The memory cap keeps less of the body than the limit, which still
+	// fails the scrape.
+	e.maxBody, e.maxMemory = 64, 32
+	mfs = gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_up"); v != 0 {
+		t.Errorf("got nginx_up %v for a body over the limit under the memory cap, want 0", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_exporter_body_limit_hits_total"); v != 2 {
+		t.Errorf("got %v limit hits, want 2", v)
+	}
+}
+
+func TestMaxScrapeMemory(t *testing.T) {
+	body := bigStatus(1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.maxMemory = 64 << 10
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_exporter_scrape_errors_total", "collector", "memory_cap"); v != 1 {
+		t.Errorf("got %v memory cap errors, want 1", v)
+	}
+	servers := len(mfs["nginx_raise"].GetMetric())
+	if servers == 0 || servers >= 1000 {
+		t.Errorf("expected part of the 1000 servers, got %d", servers)
+	}
+	if _, ok := seriesValue(mfs, "nginx_exporter_scrape_errors_total", "collector", "line"); ok {
+		t.Error("expected the body to be cut at a line end")
+	}
+	if v, _ := seriesValue(mfs, "nginx_up"); v != 1 {
+		t.Errorf("got nginx_up %v, want 1", v)
+	}
+}
+
+func TestMaxScrapeMemoryKeepsServers(t *testing.T) {
+	body := bigStatus(1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	gather(t, reg)
+
+	// The servers past the cap keep their series and aren't counted as
+	// removed, nor as added back once the whole body parses again.
+	e.maxMemory = 64 << 10
+	mfs := gather(t, reg)
+	if servers := len(mfs["nginx_raise"].GetMetric()); servers != 1000 {
+		t.Errorf("got %d servers under the cap, want the 1000 of the last scrape", servers)
+	}
+	if v, _ := seriesValue(mfs, "nginx_raise", "upstream", "us99", "name", "10.0.3.231:80"); v != 999 {
+		t.Errorf("got raise %v for the last server, want 999", v)
+	}
+	e.maxMemory = 0
+	mfs = gather(t, reg)
+	for _, name := range []string{"nginx_upstream_servers_added_total", "nginx_upstream_servers_removed_total"} {
+		for _, m := range mfs[name].GetMetric() {
+			if v := m.GetCounter().GetValue(); v != 0 {
+				t.Errorf("got %s %v, want 0", name, v)
+			}
+		}
+	}
+}
+
+func TestMaxScrapeMemoryJSON(t *testing.T) {
+	jsonStatus, err := ioutil.ReadFile("testdata/status.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jsonStatus)
+	}))
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.format, e.parse = "json", parsers["json"]
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	gather(t, reg)
+	e.maxMemory = int64(len(jsonStatus))
+	mfs := gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_exporter_scrape_errors_total", "collector", "memory_cap"); v != 1 {
+		t.Errorf("got %v memory cap errors, want 1", v)
+	}
+	if _, ok := seriesValue(mfs, "nginx_exporter_scrape_errors_total", "collector", "json"); ok {
+		t.Error("expected the cut JSON document not to be parsed")
+	}
+	if v, _ := seriesValue(mfs, "nginx_raise", "upstream", "us2", "name", "10.1.0.3:80"); v != 12 {
+		t.Errorf("got raise %v, want 12 from the last scrape", v)
+	}
+}
+
+func TestReadBodyKeep(t *testing.T) {
+	resp := func() *http.Response {
+		return &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(nginxStatus))}
+	}
+	buf, _, err := readBody(resp(), 0, 10)
+	if err != errBodyCut || buf.Len() != 10 {
+		t.Errorf("got %d bytes and error %v, want 10 and %v", buf.Len(), err, errBodyCut)
+	}
+	buf, _, err = readBody(resp(), 10, 20)
+	if err != errBodyLimit || buf.Len() != 10 {
+		t.Errorf("got %d bytes and error %v, want 10 and %v", buf.Len(), err, errBodyLimit)
+	}
+	// A body over the limit fails even if it is cut first.
+	buf, _, err = readBody(resp(), 30, 10)
+	if err != errBodyLimit || buf.Len() != 10 {
+		t.Errorf("got %d bytes and error %v, want 10 and %v", buf.Len(), err, errBodyLimit)
+	}
+	buf, _, err = readBody(resp(), int64(len(nginxStatus)), 10)
+	if err != errBodyCut || buf.Len() != 10 {
+		t.Errorf("got %d bytes and error %v for a body at the limit, want 10 and %v", buf.Len(), err, errBodyCut)
+	}
+	buf, _, err = readBody(resp(), 0, int64(len(nginxStatus)))
+	if err != nil || buf.String() != nginxStatus {
+		t.Errorf("got %q and error %v, want the whole body", buf, err)
+	}
+}
+
+func TestPutBufferDropsLarge(t *testing.T) {
+	large := bytes.NewBuffer(make([]byte, 0, 2*maxPooledBuffer))
+	putBuffer(large)
+	for i := 0; i < 10; i++ {
+		if getBuffer() == large {
+			t.Fatal("buffer over the pooled capacity was pooled")
+		}
+	}
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	body := bigStatus(1000)
+	resp := func() *http.Response {
+		return &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(body))}
+	}
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, _, err := readBody(resp(), 0, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			putBuffer(buf)
+		}
+	})
+	b.Run("readall", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ioutil.ReadAll(resp().Body); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errCircuitOpen is returned by scrapes skipped by the circuit breaker.
+var errCircuitOpen = errors.New("circuit open after repeated scrape failures")
+
+// circuitBreaker skips scrapes of a target that failed threshold scrapes in
+// a row for cooldown, to avoid piling connections on a struggling host.
+// Once the cooldown elapsed the circuit is half-open: the next scrape goes
+// through, closing the circuit on success and opening it again on failure.
+type circuitBreaker struct {
+	threshold int // 0 disables the breaker.
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether a scrape should be attempted at now.
+func (c *circuitBreaker) allow(now time.Time) bool {
+	return !c.open() || !now.Before(c.openUntil)
+}
+
+// record updates the breaker with the outcome of a scrape attempted at now.
+func (c *circuitBreaker) record(success bool, now time.Time) {
+	if success {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.open() {
+		c.openUntil = now.Add(c.cooldown)
+	}
+}
+
+// open reports whether the circuit is open or half-open.
+func (c *circuitBreaker) open() bool {
+	return c.threshold > 0 && c.failures >= c.threshold
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var requests, healthy int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.circuit = &circuitBreaker{threshold: 2, cooldown: 50 * time.Millisecond}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	check := func(step string, open, up float64, wantRequests int32) {
+		t.Helper()
+		mfs := gather(t, reg)
+		if v, _ := seriesValue(mfs, "nginx_exporter_circuit_open"); v != open {
+			t.Errorf("%s: got circuit open %v, want %v", step, v, open)
+		}
+		if v, _ := seriesValue(mfs, "nginx_up"); v != up {
+			t.Errorf("%s: got nginx_up %v, want %v", step, v, up)
+		}
+		if n := atomic.LoadInt32(&requests); n != wantRequests {
+			t.Errorf("%s: got %d requests, want %d", step, n, wantRequests)
+		}
+	}
+	check("first failure", 0, 0, 1)
+	check("second failure", 1, 0, 2)
+	check("open", 1, 0, 2)
+
+	// Half-open: a failed attempt opens the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	check("half-open failure", 1, 0, 3)
+	check("reopened", 1, 0, 3)
+
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&healthy, 1)
+	check("half-open success", 0, 1, 4)
+	check("closed", 0, 1, 5)
+}
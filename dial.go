@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// dialer dials status endpoints. A host resolving to both IPv4 and IPv6
+// addresses is dialed over the preferred stack first, racing the other one
+// after the fallback delay (happy eyeballs), so that a broken IPv6 route
+// doesn't hang scrapes until they time out.
+type dialer struct {
+	net.Dialer
+	preferIPv4 bool // Dial IPv4 addresses only.
+}
+
+func newDialer(fallbackDelay time.Duration, preferIPv4 bool) *dialer {
+	return &dialer{
+		Dialer: net.Dialer{
+			KeepAlive:     30 * time.Second,
+			FallbackDelay: fallbackDelay,
+		},
+		preferIPv4: preferIPv4,
+	}
+}
+
+// DialContext connects to addr, over IPv4 only for -nginx.prefer-ipv4.
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.preferIPv4 && network == "tcp" {
+		network = "tcp4"
+	}
+	return d.Dialer.DialContext(ctx, network, addr)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeResolver resolves every name to addrs by answering the DNS queries of
+// the Go resolver over an in-memory connection.
+func fakeResolver(addrs ...net.IP) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serveDNS(server, addrs)
+			return client, nil
+		},
+	}
+}
+
+// serveDNS answers the length-prefixed queries read from c with the A or
+// AAAA records of addrs until c is closed.
+func serveDNS(c net.Conn, addrs []net.IP) {
+	defer c.Close()
+	for {
+		var n uint16
+		if err := binary.Read(c, binary.BigEndian, &n); err != nil {
+			return
+		}
+		query := make([]byte, n)
+		if _, err := io.ReadFull(c, query); err != nil {
+			return
+		}
+		end := 12
+		for query[end] != 0 {
+			end += int(query[end]) + 1
+		}
+		question := query[12 : end+5]
+		qtype := binary.BigEndian.Uint16(query[end+1:])
+
+		var answers [][]byte
+		for _, ip := range addrs {
+			switch ip4 := ip.To4(); {
+			case qtype == 1 && ip4 != nil:
+				answers = append(answers, ip4)
+			case qtype == 28 && ip4 == nil:
+				answers = append(answers, ip.To16())
+			}
+		}
+		resp := append([]byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, byte(len(answers)), 0, 0, 0, 0}, question...)
+		for _, rdata := range answers {
+			// The name points back to the question.
+			resp = append(resp, 0xc0, 12, byte(qtype>>8), byte(qtype), 0, 1, 0, 0, 0, 60, 0, byte(len(rdata)))
+			resp = append(resp, rdata...)
+		}
+		if err := binary.Write(c, binary.BigEndian, uint16(len(resp))); err != nil {
+			return
+		}
+		if _, err := c.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestPreferIPv4(t *testing.T) {
+	v4, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := v4.Addr().(*net.TCPAddr).Port
+	v6, err := net.Listen("tcp6", fmt.Sprintf("[::1]:%d", port))
+	if err != nil {
+		v4.Close()
+		t.Skipf("no dual-stack loopback: %s", err)
+	}
+	var stack string
+	for _, l := range []struct {
+		listener net.Listener
+		stack    string
+	}{{v4, "ipv4"}, {v6, "ipv6"}} {
+		l := l
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			stack = l.stack
+			w.Write([]byte(nginxStatus))
+		}))
+		server.Listener.Close()
+		server.Listener = l.listener
+		server.Start()
+		defer server.Close()
+	}
+
+	for _, tt := range []struct {
+		preferIPv4 bool
+		want       string
+	}{
+		{false, "ipv6"},
+		{true, "ipv4"},
+	} {
+		stack = ""
+		*preferIPv4 = tt.preferIPv4
+		e := NewExporter(fmt.Sprintf("http://dualstack.test:%d/status", port))
+		*preferIPv4 = false
+		e.dialer.Resolver = fakeResolver(net.ParseIP("::1"), net.ParseIP("127.0.0.1"))
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(e)
+		if v, _ := seriesValue(gather(t, reg), "nginx_up"); v != 1 {
+			t.Fatalf("prefer IPv4 %t: expected nginx_up 1, got %v", tt.preferIPv4, v)
+		}
+		if stack != tt.want {
+			t.Errorf("prefer IPv4 %t: expected a scrape over %s, got %q", tt.preferIPv4, tt.want, stack)
+		}
+	}
+}
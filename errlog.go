@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/log"
+)
+
+// errorLog logs scrape errors, logging an error identical to the previous
+// one at most once per interval. The repeats in between are counted and
+// reported with the next error logged. It logs every error if interval is
+// zero.
+type errorLog struct {
+	interval time.Duration
+	errorf   func(format string, v ...interface{})
+	warnf    func(format string, v ...interface{})
+	now      func() time.Time
+
+	mutex      sync.Mutex
+	last       string
+	lastLogged time.Time
+	suppressed int
+}
+
+func newErrorLog(interval time.Duration) *errorLog {
+	return &errorLog{interval: interval, errorf: log.Errorf, warnf: log.Warnf, now: time.Now}
+}
+
+// Errorf logs the error formatted from format and v unless it repeats the
+// error logged less than the interval ago.
+func (l *errorLog) Errorf(format string, v ...interface{}) {
+	l.print(l.errorf, format, v...)
+}
+
+// Warnf is Errorf for errors logged as warnings.
+func (l *errorLog) Warnf(format string, v ...interface{}) {
+	l.print(l.warnf, format, v...)
+}
+
+func (l *errorLog) print(logf func(format string, v ...interface{}), format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	now := l.now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.interval > 0 && msg == l.last && now.Sub(l.lastLogged) < l.interval {
+		l.suppressed++
+		return
+	}
+	switch {
+	case l.suppressed > 0 && msg == l.last:
+		logf("%s (repeated %d times since %s)", msg, l.suppressed, l.lastLogged.Format(time.RFC3339))
+	case l.suppressed > 0:
+		logf("Previous error repeated %d times since %s: %s", l.suppressed, l.lastLogged.Format(time.RFC3339), l.last)
+		logf("%s", msg)
+	default:
+		logf("%s", msg)
+	}
+	l.last = msg
+	l.lastLogged = now
+	l.suppressed = 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// capture makes l record the messages it logs instead of logging them.
+func capture(l *errorLog) *[]string {
+	var logged []string
+	logf := func(format string, v ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, v...))
+	}
+	l.errorf, l.warnf = logf, logf
+	return &logged
+}
+
+func TestErrorLog(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newErrorLog(time.Minute)
+	l.now = func() time.Time { return now }
+	logged := capture(l)
+
+	for i := 0; i < 10; i++ {
+		l.Errorf("Error calling nginx status API: %s", "connection refused")
+		now = now.Add(time.Second)
+	}
+	if len(*logged) != 1 {
+		t.Fatalf("expected 1 log within the interval, got %q", *logged)
+	}
+
+	now = now.Add(time.Minute)
+	l.Errorf("Error calling nginx status API: %s", "connection refused")
+	if len(*logged) != 2 || !strings.Contains((*logged)[1], "repeated 9 times") {
+		t.Fatalf("expected a log counting 9 repeats after the interval, got %q", *logged)
+	}
+
+	l.Errorf("Error calling nginx status API: %s", "connection refused")
+	l.Warnf("Status 503 Service Unavailable (503): busy")
+	if len(*logged) != 4 || !strings.Contains((*logged)[2], "Previous error repeated 1 times") || (*logged)[3] != "Status 503 Service Unavailable (503): busy" {
+		t.Errorf("expected a different error to be logged at once after a summary, got %q", *logged)
+	}
+}
+
+func TestErrorLogScrapes(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.errLog = newErrorLog(time.Hour)
+	logged := capture(e.errLog)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	for i := 0; i < 20; i++ {
+		gather(t, reg)
+	}
+	if len(*logged) != 1 {
+		t.Errorf("expected 1 log for 20 identical scrape errors, got %q", *logged)
+	}
+}
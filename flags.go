@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables flags are read from.
+const envPrefix = "NGINX_EXPORTER_"
+
+// envName returns the environment variable for the flag name, e.g.
+// NGINX_EXPORTER_NGINX_SCRAPE_URI for -nginx.scrape_uri.
+func envName(prefix, name string) string {
+	return prefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// applyEnv sets every flag of fs that wasn't given on the command line from
+// its environment variable, if set, so that the command line takes
+// precedence over the environment and the environment over the defaults.
+// Values are parsed by the flags themselves, and an invalid value is an
+// error rather than a silent fallback to the default.
+func applyEnv(fs *flag.FlagSet, prefix string, lookup func(string) (string, bool)) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := envName(prefix, f.Name)
+		v, ok := lookup(name)
+		if !ok {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("invalid value %q for environment variable %s (flag -%s): %s", v, name, f.Name, e)
+		}
+	})
+	return err
+}
+
+// regexpFlag is a flag holding a regular expression, compiled when the
+// flags are parsed.
+type regexpFlag struct {
+	*regexp.Regexp
+}
+
+func (f *regexpFlag) String() string {
+	if f.Regexp == nil {
+		return ""
+	}
+	return f.Regexp.String()
+}
+
+func (f *regexpFlag) Set(v string) error {
+	re, err := regexp.Compile(v)
+	if err != nil {
+		return err
+	}
+	f.Regexp = re
+	return nil
+}
+
+// serverLabelFields are the server fields a -metrics.label-template may
+// select as labels; order is the index tengine reports the server at.
+var serverLabelFields = []string{"upstream", "name", "type", "section", "order", "weight"}
+
+// labelsFlag is a flag holding a comma-separated list of server fields,
+// checked against serverLabelFields when the flags are parsed.
+type labelsFlag []string
+
+func (f *labelsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *labelsFlag) Set(v string) error {
+	var labels labelsFlag
+	for _, l := range strings.Split(v, ",") {
+		l = strings.TrimSpace(l)
+		if !labelsFlag(serverLabelFields).has(l) {
+			return fmt.Errorf("unknown server field %q, must be one of %s", l, strings.Join(serverLabelFields, ", "))
+		}
+		if labels.has(l) {
+			return fmt.Errorf("duplicate server field %q", l)
+		}
+		labels = append(labels, l)
+	}
+	*f = labels
+	return nil
+}
+
+// has reports whether f holds the label l.
+func (f labelsFlag) has(l string) bool {
+	for _, label := range f {
+		if label == l {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func newTestFlagSet() (*flag.FlagSet, *string, *bool) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	uri := fs.String("nginx.scrape_uri", "http://localhost/nginx_status", "")
+	insecure := fs.Bool("insecure", true, "")
+	return fs, uri, insecure
+}
+
+func TestApplyEnvPrecedence(t *testing.T) {
+	env := map[string]string{
+		"NGINX_EXPORTER_NGINX_SCRAPE_URI": "http://env/status",
+		"NGINX_EXPORTER_INSECURE":         "false",
+	}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+
+	fs, uri, insecure := newTestFlagSet()
+	if err := fs.Parse([]string{"-nginx.scrape_uri=http://cli/status"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnv(fs, envPrefix, lookup); err != nil {
+		t.Fatal(err)
+	}
+	if *uri != "http://cli/status" {
+		t.Errorf("command line should take precedence, got %q", *uri)
+	}
+	if *insecure {
+		t.Error("environment should take precedence over default")
+	}
+
+	fs, uri, insecure = newTestFlagSet()
+	fs.Parse(nil)
+	if err := applyEnv(fs, envPrefix, func(string) (string, bool) { return "", false }); err != nil {
+		t.Fatal(err)
+	}
+	if *uri != "http://localhost/nginx_status" || !*insecure {
+		t.Errorf("expected defaults, got %q and %v", *uri, *insecure)
+	}
+}
+
+func TestApplyEnvInvalidBool(t *testing.T) {
+	fs, _, _ := newTestFlagSet()
+	fs.Parse(nil)
+	err := applyEnv(fs, envPrefix, func(k string) (string, bool) {
+		if k == "NGINX_EXPORTER_INSECURE" {
+			return "maybe", true
+		}
+		return "", false
+	})
+	if err == nil {
+		t.Fatal("expected error for invalid boolean")
+	}
+	for _, want := range []string{`"maybe"`, "NGINX_EXPORTER_INSECURE", "-insecure"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q should mention %s", err, want)
+		}
+	}
+}
+
+func TestLabelsFlag(t *testing.T) {
+	var f labelsFlag
+	if err := f.Set("upstream, name,type"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.String(); got != "upstream,name,type" {
+		t.Errorf("got %q, want upstream,name,type", got)
+	}
+	for _, v := range []string{"upstream,port", "upstream,name,upstream", ""} {
+		if err := f.Set(v); err == nil {
+			t.Errorf("expected an error for %q", v)
+		}
+	}
+}
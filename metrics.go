@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricHelp holds the -metric.help overrides.
+var metricHelp = helpFlag{}
+
+// helpFlag is a repeatable flag of name=text pairs overriding the help text
+// of the metric with the given fully-qualified name.
+type helpFlag map[string]string
+
+func (h helpFlag) String() string {
+	var pairs []string
+	for name, text := range h {
+		pairs = append(pairs, name+"="+text)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (h helpFlag) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected name=text, got %q", v)
+	}
+	h[parts[0]] = strings.Trim(parts[1], `"`)
+	return nil
+}
+
+// knownMetrics records the names of all metrics constructed through
+// metricOpts, to validate help overrides against. Exporters are built
+// concurrently, e.g. by probes, so it is guarded by knownMetricsMutex.
+var (
+	knownMetrics      = map[string]bool{}
+	knownMetricsMutex sync.Mutex
+)
+
+// validate returns an error if an override names a metric that doesn't exist.
+// A collector of each kind is built first, so that all names are known even
+// before any target was discovered or read from the targets file.
+func (h helpFlag) validate() error {
+	NewExporter("http://localhost/")
+	newMultiExporter(false)
+	newHeartbeat()
+	newFeaturesInfo(false)
+	knownMetricsMutex.Lock()
+	defer knownMetricsMutex.Unlock()
+	for name := range h {
+		if !knownMetrics[name] {
+			return fmt.Errorf("-metric.help: unknown metric %q", name)
+		}
+	}
+	return nil
+}
+
+func (h helpFlag) apply(o *prometheus.Opts) {
+	name := prometheus.BuildFQName(o.Namespace, o.Subsystem, o.Name)
+	knownMetricsMutex.Lock()
+	knownMetrics[name] = true
+	knownMetricsMutex.Unlock()
+	if text, ok := h[name]; ok {
+		o.Help = text
+	}
+}
+
+// withSubsystem prefixes the subsystem of a metric with -metrics.subsystem,
+// e.g. nginx_raise becomes nginx_tengine_raise and
+// nginx_exporter_frozen nginx_tengine_exporter_frozen.
+func withSubsystem(subsystem string) string {
+	switch {
+	case *metricsSubsystem == "":
+		return subsystem
+	case subsystem == "":
+		return *metricsSubsystem
+	default:
+		return *metricsSubsystem + "_" + subsystem
+	}
+}
+
+// reqstatSubsystem is reserved for the metrics of tengine's reqstat module,
+// nginx_reqstat_*, which count traffic per location and must stay apart from
+// the upstream check metrics, nginx_* and nginx_upstream_*.
+const reqstatSubsystem = "reqstat"
+
+// validateSubsystem returns an error if -metrics.subsystem s would move the
+// check metrics under the reserved reqstat subsystem.
+func validateSubsystem(s string) error {
+	if s == reqstatSubsystem || strings.HasPrefix(s, reqstatSubsystem+"_") {
+		return fmt.Errorf("-metrics.subsystem %q would collide with the reserved nginx_%s_ metrics", s, reqstatSubsystem)
+	}
+	return nil
+}
+
+// metricOpts completes the options of the metrics of an Exporter.
+type metricOpts struct {
+	constLabels prometheus.Labels
+}
+
+func (m metricOpts) apply(o *prometheus.Opts) {
+	o.Subsystem = withSubsystem(o.Subsystem)
+	metricHelp.apply(o)
+	o.ConstLabels = m.constLabels
+}
+
+// gauge applies the command-line metric overrides and const labels to o.
+func (m metricOpts) gauge(o prometheus.GaugeOpts) prometheus.GaugeOpts {
+	m.apply((*prometheus.Opts)(&o))
+	return o
+}
+
+// counter applies the command-line metric overrides and const labels to o.
+func (m metricOpts) counter(o prometheus.CounterOpts) prometheus.CounterOpts {
+	m.apply((*prometheus.Opts)(&o))
+	return o
+}
+
+// histogram applies the command-line metric overrides and const labels to o.
+func (m metricOpts) histogram(o prometheus.HistogramOpts) prometheus.HistogramOpts {
+	opts := prometheus.Opts{Namespace: o.Namespace, Subsystem: o.Subsystem, Name: o.Name, Help: o.Help}
+	m.apply(&opts)
+	o.Subsystem, o.Help, o.ConstLabels = opts.Subsystem, opts.Help, opts.ConstLabels
+	return o
+}
+
+// desc applies the command-line metric overrides and const labels to o and
+// returns the description of a metric of it with the given variable labels,
+// for metrics made at collect time.
+func (m metricOpts) desc(o prometheus.Opts, labels []string) *prometheus.Desc {
+	m.apply(&o)
+	return prometheus.NewDesc(prometheus.BuildFQName(o.Namespace, o.Subsystem, o.Name), o.Help, labels, o.ConstLabels)
+}
+
+// newFeaturesInfo returns a collector of nginx_exporter_features_info,
+// labelled with whether each optional feature is enabled ("1") or not ("0").
+func newFeaturesInfo(multiTarget bool) prometheus.Collector {
+	_, spnego := authorizers["negotiate"]
+	_, brotli := decoders["br"]
+	features := []struct {
+		name    string
+		enabled bool
+	}{
+		{"cache", *cacheTTL > 0},
+		{"retry", *scrapeRetries > 0},
+		{"multi_target", multiTarget},
+		{"targets_file", *targetsFile != ""},
+		{"srv", *srvRecord != ""},
+		{"circuit_breaker", *circuitFailures > 0},
+		{"flap_debounce", *flapDebounce > 0},
+		{"gzip", *requestGzip},
+		{"brotli", brotli},
+		{"trace", *traceScrapes},
+		{"spnego", spnego},
+		{"auth", *authMode != ""},
+	}
+	var names, values []string
+	for _, f := range features {
+		names = append(names, f.name)
+		values = append(values, "0")
+		if f.enabled {
+			values[len(values)-1] = "1"
+		}
+	}
+	info := prometheus.NewGaugeVec(metricOpts{}.gauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "features_info",
+		Help:      "Optional features of the exporter, as labels that are 1 if the feature is enabled or compiled in.",
+	}), names)
+	info.WithLabelValues(values...).Set(1)
+	return info
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHelpOverride(t *testing.T) {
+	if err := metricHelp.Set(`nginx_up="Ob der Nginx-Server läuft."`); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(metricHelp, "nginx_up")
+
+	e := NewExporter("http://localhost")
+	if err := metricHelp.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		defer close(ch)
+		e.Describe(ch)
+	}()
+	found := false
+	for d := range ch {
+		if strings.Contains(d.String(), `"nginx_up"`) {
+			found = strings.Contains(d.String(), `"Ob der Nginx-Server läuft."`)
+		}
+	}
+	if !found {
+		t.Error("help override missing from nginx_up description")
+	}
+}
+
+func TestHelpOverrideUnknownMetric(t *testing.T) {
+	if err := metricHelp.Set("nginx_bogus=text"); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(metricHelp, "nginx_bogus")
+
+	NewExporter("http://localhost")
+	if err := metricHelp.validate(); err == nil {
+		t.Error("expected error for unknown metric")
+	}
+	if err := metricHelp.Set("no-equals-sign"); err == nil {
+		t.Error("expected error for malformed override")
+	}
+}
+
+func TestHelpOverrideWithoutTargets(t *testing.T) {
+	saved := knownMetrics
+	defer func() { knownMetrics = saved }()
+	// As in main with a targets file or SRV record listing no target yet.
+	knownMetrics = map[string]bool{}
+	for _, name := range []string{"nginx_raise", "nginx_exporter_heartbeat", "nginx_exporter_features_info", "nginx_exporter_target_scrape_panics_total"} {
+		metricHelp[name] = "text"
+		defer delete(metricHelp, name)
+	}
+	if err := metricHelp.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newHeartbeat())
+	if help := gather(t, reg)["nginx_exporter_heartbeat"].GetHelp(); help != "text" {
+		t.Errorf("got heartbeat help %q, want the override", help)
+	}
+}
+
+func TestMetricsSubsystem(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	}))
+	defer server.Close()
+
+	*metricsSubsystem = "tengine"
+	defer func() { *metricsSubsystem = "" }()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL), newHeartbeat())
+	mfs := gather(t, reg)
+
+	for _, name := range []string{"nginx_tengine_up", "nginx_tengine_raise", "nginx_tengine_exporter_last_scrape_error", "nginx_tengine_exporter_heartbeat"} {
+		if _, ok := mfs[name]; !ok {
+			t.Errorf("%s missing", name)
+		}
+	}
+	for name := range mfs {
+		if !strings.HasPrefix(name, "nginx_tengine_") {
+			t.Errorf("%s lacks the subsystem", name)
+		}
+	}
+}
+
+func TestReqstatSubsystemReserved(t *testing.T) {
+	for s, valid := range map[string]bool{"": true, "tengine": true, "reqstats": true, "reqstat": false, "reqstat_check": false} {
+		if err := validateSubsystem(s); (err == nil) != valid {
+			t.Errorf("subsystem %q: got error %v, want valid %t", s, err, valid)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	}))
+	defer server.Close()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL), newHeartbeat())
+	for name := range gather(t, reg) {
+		if strings.HasPrefix(name, "nginx_"+reqstatSubsystem+"_") {
+			t.Errorf("check metric %s is in the reserved reqstat subsystem", name)
+		}
+	}
+}
+
+func TestFeaturesInfo(t *testing.T) {
+	*scrapeRetries, *requestGzip, *cacheTTL = 2, true, time.Second
+	defer func() { *scrapeRetries, *requestGzip, *cacheTTL = 0, false, 0 }()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newFeaturesInfo(true))
+	v, ok := seriesValue(gather(t, reg), "nginx_exporter_features_info",
+		"cache", "1", "retry", "1", "multi_target", "1", "gzip", "1", "circuit_breaker", "0", "trace", "0")
+	if !ok || v != 1 {
+		t.Error("features info doesn't reflect the enabled features")
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/log"
+)
+
+// scrapeGoroutines is the number of running goroutines spawned to scrape
+// targets, relay their metrics or parse status bodies. Accessed atomically.
+var scrapeGoroutines int64
+
+// processStart is when the exporter started, and first loaded its config.
+var processStart = time.Now()
+
+// MultiExporter scrapes one or more status URIs concurrently. With several
+// URIs, the metrics of each carry a target label holding the URI's host.
+// With -metrics.add-host-label, they carry a host label in any case.
+// Each target is scraped in its own goroutine so that a failure, even a
+// panic, while scraping one of them doesn't affect the others.
+//
+// A dynamic MultiExporter, whose targets are discovered at runtime, always
+// labels metrics with the target and is an unchecked collector, since its
+// descriptors change with the targets.
+type MultiExporter struct {
+	mutex     sync.RWMutex // Protects exporters.
+	exporters []*Exporter
+	dynamic   bool
+	authorize authorizer
+	panics    *prometheus.CounterVec
+	spawned   prometheus.GaugeFunc
+	limit     int // Targets scraped in parallel, all if 0.
+
+	// concurrency holds the most targets scraped in parallel during the
+	// last collect.
+	concurrency prometheus.Gauge
+
+	// configHash holds the hash of the targets file, if any.
+	configHash *prometheus.GaugeVec
+
+	// configReload holds the time of the last successful load of the
+	// targets file, the process start until then.
+	configReload prometheus.Gauge
+
+	reloadMutex sync.Mutex // Protects lastReload.
+	lastReload  *reloadStatus
+}
+
+// NewMultiExporter returns an initialized MultiExporter.
+func NewMultiExporter(uris []string) (*MultiExporter, error) {
+	m := newMultiExporter(false)
+	if err := m.setTargets(uris, nil); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func newMultiExporter(dynamic bool) *MultiExporter {
+	m := &MultiExporter{
+		dynamic: dynamic,
+		limit:   *maxConcurrent,
+		panics: prometheus.NewCounterVec(metricOpts{}.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "target_scrape_panics_total",
+			Help:      "Number of recovered panics while scraping a target.",
+		}), []string{"uri"}),
+		spawned: prometheus.NewGaugeFunc(metricOpts{}.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrape_goroutines",
+			Help:      "Number of running goroutines the exporter spawned for scraping.",
+		}), func() float64 { return float64(atomic.LoadInt64(&scrapeGoroutines)) }),
+		concurrency: prometheus.NewGauge(metricOpts{}.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "target_scrape_concurrency",
+			Help:      "Most targets scraped in parallel during the last collect, at most -nginx.target-concurrency.",
+		})),
+		configHash: prometheus.NewGaugeVec(metricOpts{}.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "config_file_hash_info",
+			Help:      "Truncated SHA-256 of the loaded targets file.",
+		}), []string{"hash"}),
+		configReload: prometheus.NewGauge(metricOpts{}.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "config_last_reload_timestamp_seconds",
+			Help:      "Time of the last successful load of the targets file, or of the process start.",
+		})),
+	}
+	m.configReload.Set(float64(processStart.UnixNano()) / 1e9)
+	return m
+}
+
+// setTargets replaces the scraped URIs. Exporters of URIs already scraped
+// are kept along with their state. formats holds the parser of the URIs not
+// in the format of -nginx.format. The series of removed targets, including
+// their panic counts, are no longer exported, so that Prometheus marks them
+// stale on its next scrape rather than seeing them frozen.
+func (m *MultiExporter) setTargets(uris []string, formats map[string]string) error {
+	current := map[string]*Exporter{}
+	for _, e := range m.targets() {
+		current[e.URI] = e
+	}
+	var exporters []*Exporter
+	seen := map[string]bool{}
+	for _, uri := range uris {
+		uri = strings.TrimSpace(uri)
+		u, err := url.Parse(uri)
+		if err != nil {
+			return fmt.Errorf("invalid scrape URI %q: %s", redactURI(uri), err)
+		}
+		if seen[u.Host] {
+			return fmt.Errorf("duplicate scrape target %q", u.Host)
+		}
+		seen[u.Host] = true
+		format, ok := formats[uri]
+		if !ok {
+			format = *statusFormat
+		}
+		if e, ok := current[uri]; ok {
+			e.setFormat(format)
+			exporters = append(exporters, e)
+			delete(current, uri)
+			continue
+		}
+
+		// The host never includes the URI's user info.
+		labels := prometheus.Labels{}
+		if len(uris) > 1 || m.dynamic {
+			labels["target"] = u.Host
+		}
+		if *addHostLabel {
+			labels["host"] = u.Host
+		}
+		e := NewExporterWithLabels(uri, labels)
+		e.format, e.parse = format, parsers[format]
+		e.authorize = m.authorize
+		exporters = append(exporters, e)
+	}
+
+	m.mutex.Lock()
+	m.exporters = exporters
+	m.mutex.Unlock()
+	// The exporters left in current are those of removed targets.
+	for uri, e := range current {
+		log.Infof("No longer scraping %s", redactURI(uri))
+		m.panics.DeleteLabelValues(redactURI(uri))
+		e.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// targets returns the exporters of the current targets.
+func (m *MultiExporter) targets() []*Exporter {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.exporters
+}
+
+// setAuthorizer makes all current and future targets authenticate their
+// status requests with authorize.
+func (m *MultiExporter) setAuthorizer(authorize authorizer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.authorize = authorize
+	for _, e := range m.exporters {
+		e.authorize = authorize
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *MultiExporter) Describe(ch chan<- *prometheus.Desc) {
+	if m.dynamic {
+		return
+	}
+	for _, e := range m.targets() {
+		e.Describe(ch)
+	}
+	m.panics.Describe(ch)
+	m.spawned.Describe(ch)
+	m.concurrency.Describe(ch)
+	m.configHash.Describe(ch)
+	m.configReload.Describe(ch)
+}
+
+// Collect scrapes all targets concurrently, at most limit at a time if
+// limit is positive. It implements prometheus.Collector.
+func (m *MultiExporter) Collect(ch chan<- prometheus.Metric) {
+	var (
+		wg           sync.WaitGroup
+		slots        chan struct{}
+		active, peak int64
+	)
+	if m.limit > 0 {
+		slots = make(chan struct{}, m.limit)
+	}
+	for _, e := range m.targets() {
+		wg.Add(1)
+		atomic.AddInt64(&scrapeGoroutines, 1)
+		go func(e *Exporter) {
+			defer wg.Done()
+			defer atomic.AddInt64(&scrapeGoroutines, -1)
+			if slots != nil {
+				slots <- struct{}{}
+				defer func() { <-slots }()
+			}
+			n := atomic.AddInt64(&active, 1)
+			defer atomic.AddInt64(&active, -1)
+			for {
+				p := atomic.LoadInt64(&peak)
+				if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+					break
+				}
+			}
+			defer func() {
+				if r := recover(); r != nil {
+					uri := redactURI(e.URI)
+					log.Errorf("Recovered from panic scraping %s: %v", uri, r)
+					m.panics.WithLabelValues(uri).Inc()
+				}
+			}()
+			e.Collect(ch)
+		}(e)
+	}
+	wg.Wait()
+	m.concurrency.Set(float64(peak))
+	m.panics.Collect(ch)
+	ch <- m.spawned
+	ch <- m.concurrency
+	m.configHash.Collect(ch)
+	ch <- m.configReload
+}
+
+// ResetParseDurationMax forgets the longest parse duration of all targets.
+func (m *MultiExporter) ResetParseDurationMax() {
+	for _, e := range m.targets() {
+		e.ResetParseDurationMax()
+	}
+}
+
+// SetFrozen freezes or resumes scraping of all targets.
+func (m *MultiExporter) SetFrozen(frozen bool) {
+	for _, e := range m.targets() {
+		e.SetFrozen(frozen)
+	}
+}
+
+// Frozen reports whether scraping of all targets is frozen.
+func (m *MultiExporter) Frozen() bool {
+	for _, e := range m.targets() {
+		if !e.Frozen() {
+			return false
+		}
+	}
+	return true
+}
+
+// exporterFor returns the exporter of the target with the given host, or
+// the only exporter if target is empty and there is a single one.
+func (m *MultiExporter) exporterFor(target string) *Exporter {
+	exporters := m.targets()
+	if target == "" && len(exporters) == 1 {
+		return exporters[0]
+	}
+	for _, e := range exporters {
+		if u, err := url.Parse(e.URI); err == nil && u.Host == target {
+			return e
+		}
+	}
+	return nil
+}
+
+// redactURI returns uri with any password replaced, for logs and labels.
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
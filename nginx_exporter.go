@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -22,10 +34,88 @@ const (
 var (
 	listeningAddress = flag.String("telemetry.address", ":9113", "Address on which to expose metrics.")
 	metricsEndpoint  = flag.String("telemetry.endpoint", "/metrics", "Path under which to expose metrics.")
-	nginxScrapeURI   = flag.String("nginx.scrape_uri", "http://localhost/nginx_status", "URI to nginx stub status page")
+	nginxScrapeURI   = flag.String("nginx.scrape_uri", "http://localhost/nginx_status", "URI to nginx stub status page, comma-separated to scrape several targets")
+	targetsFile      = flag.String("nginx.targets-file", "", "Scrape the URIs listed in this file, one per line, instead of -nginx.scrape_uri")
+	targetsReload    = flag.Duration("nginx.targets-file-reload-interval", 0, "Interval at which -nginx.targets-file is read again (never if 0)")
+	srvRecord        = flag.String("nginx.srv-record", "", "Scrape the targets of this DNS SRV record, using the scheme and path of -nginx.scrape_uri")
+	reqstatURI       = flag.String("nginx.reqstat-uri", "", "Also scrape tengine's req_status_show page at this URI, relative to each scrape URI, and export it as nginx_reqstat_* (not scraped if empty)")
+	srvInterval      = flag.Duration("nginx.srv-interval", 30*time.Second, "Interval at which -nginx.srv-record is resolved again")
+	emptyFieldZero   = flag.Bool("nginx.empty-field-as-zero", false, "Parse empty numeric status fields, e.g. a blank rise or fall, as 0 instead of reporting a parse error")
+	commentPrefix    = flag.String("nginx.comment-prefix", "#", "Skip status lines starting with this prefix (none skipped if empty)")
+	statusFormat     = flag.String("nginx.format", "csv", "Format of the status body: csv, json, kv for key=value pairs, reqstat for tengine's req_status_show or stub_status")
+	requestMethod    = flag.String("nginx.method", "GET", "HTTP method of status requests, GET or POST")
+	noExpectContinue = flag.Bool("nginx.disable-expect-continue", true, "Never send Expect: 100-continue with POST status requests")
+	requestGzip      = flag.Bool("nginx.gzip", false, "Request compressed status bodies, gzip or also br if built with -tags brotli, and export their decompression ratio")
+	maxBodyBytes     = flag.Int64("nginx.max-body-bytes", 0, "Fail scrapes whose decompressed status body is longer than this many bytes (no limit if 0)")
+	paginate         = flag.Bool("nginx.paginate", false, "Follow the pages of a paginated status, by Link rel=next or X-Total-Pages headers, and merge them")
+	preferIPv4       = flag.Bool("nginx.prefer-ipv4", false, "Connect to status endpoints over IPv4 only, for hosts whose IPv6 route is broken")
+	fallbackDelay    = flag.Duration("nginx.dial-fallback-delay", 300*time.Millisecond, "Time a connection over IPv6 is given before racing one over IPv4 to a dual-stack host (no fallback if negative)")
+	maxRedirects     = flag.Int("nginx.max-redirects", 10, "Number of redirects a status request follows before failing")
 	insecure         = flag.Bool("insecure", true, "Ignore server certificate if using https")
+	maxScrapeMemory  = flag.Int64("nginx.max-scrape-memory", 0, "Read and parse only the status lines projected to fit in this many bytes, reporting a memory_cap scrape error if lines are left out, whose servers keep their last states (no cap if 0)")
+	failClosed       = flag.Bool("nginx.fail-closed-on-startup", false, "Exit if a target can't be scraped at startup instead of serving nginx_up 0")
+	cacheTTL         = flag.Duration("nginx.cache-ttl", 0, "Serve collects within this duration of the last successful scrape from its metrics instead of scraping again (disabled if 0)")
+	scrapeTimeout    = flag.Duration("nginx.timeout", 0, "Timeout of a status request, including reading the body (no timeout if 0)")
+	allowedCIDRs     = flag.String("web.allowed-cidrs", "", "Comma-separated list of CIDRs allowed to scrape metrics (default allow all)")
+	trustXFF         = flag.Bool("web.trust-xff", false, "Use the last X-Forwarded-For entry, appended by the proxy in front of the exporter, as the client address for -web.allowed-cidrs")
+	maxConcurrent    = flag.Int("nginx.target-concurrency", 0, "Number of targets scraped in parallel (all if 0)")
+	parseWorkers     = flag.Int("nginx.parse-workers", 1, "Number of goroutines parsing the status body concurrently")
+	successWindow    = flag.Int("nginx.scrape-success-window", 10, "Number of recent scrapes nginx_exporter_scrape_success_ratio is computed over")
+	upRequiresParse  = flag.Bool("nginx.up-requires-parse", false, "Report nginx_up 0 if no status line could be parsed")
+	traceScrapes     = flag.Bool("nginx.trace", false, "Trace status requests and export detailed timings")
+	probeTimeout     = flag.Duration("nginx.probe-timeout", 10*time.Second, "Timeout of a scrape through the probe endpoint, lowered to Prometheus's scrape timeout if that is shorter")
+	probePath        = flag.String("web.probe-path", "", "Path under which to scrape the status URI given by the target parameter (disabled if empty)")
+	adminAddress     = flag.String("web.admin-address", "", "Address on which to expose admin endpoints (disabled if empty)")
+	freeze           = flag.Bool("nginx.freeze", false, "Start with scraping frozen, serving the last metrics (toggle with /-/freeze on the admin address)")
+	addHostLabel     = flag.Bool("metrics.add-host-label", false, "Add a host label holding the scrape URI's host to all metrics")
+	scrapeRetries    = flag.Int("nginx.retries", 0, "Number of times a failed status request is retried per scrape")
+	riseFallMode     = flag.String("nginx.rise-fall-mode", "cumulative", "Export rise/fall counts as reported by tengine, also as the counters nginx_raise_total and nginx_fail_total (cumulative), or their change since the previous scrape (delta)")
+	aggInterval      = flag.Duration("nginx.aggregation-interval", 0, "With -nginx.rise-fall-mode=delta, scale the rise/fall changes to their change per this interval, however far apart the scrapes are, and count -nginx.flap-debounce in intervals rather than scrapes (unscaled if 0)")
+	connectionClose  = flag.Bool("nginx.connection-close", false, "Send Connection: close, opening a new connection for every status request")
+	lastBodyBytes    = flag.Int("web.debug-last-body-bytes", 0, "Keep up to this many bytes of the last status body for /debug/last-body on the admin address (disabled if 0)")
+	collectRaise     = flag.Bool("collector.raise", true, "Export nginx_raise")
+	collectFail      = flag.Bool("collector.fail", true, "Export nginx_fail")
+	collectServerUp  = flag.Bool("collector.server-up", true, "Export nginx_server_up")
+	collectUpstreams = flag.Bool("collector.upstream-aggregates", true, "Export the metrics aggregated per upstream")
+	sectionLabel     = flag.Bool("nginx.sections", false, "Label per-server metrics with the section of the status body they are in; sections are separated by empty lines")
+	typeIdentity     = flag.Bool("metrics.type-in-identity", false, "Tell apart servers of an upstream sharing a name by their check type, adding a type label to per-server metrics; otherwise only the first of them is kept")
+	debugRawColumns  = flag.Bool("metrics.debug-raw-columns", false, "Export the columns of the first server line of the status body as nginx_exporter_raw_column, to check the column layout of an unfamiliar tengine build")
+	orderLabel       = flag.Bool("metrics.include-order-label", false, "Label per-server metrics with the index tengine reports the server at, as order; the index is renumbered when servers are added or removed")
+	createdSamples   = flag.Bool("web.openmetrics-created", false, "Add _created samples for counters when OpenMetrics is negotiated")
+	circuitFailures  = flag.Int("nginx.circuit-failures", 0, "Skip scrapes for -nginx.circuit-cooldown after this many consecutive failed scrapes (disabled if 0)")
+	circuitCooldown  = flag.Duration("nginx.circuit-cooldown", 30*time.Second, "Time scrapes are skipped for once the circuit opened")
+	fallRatio        = flag.Float64("nginx.fall-ratio-threshold", 0, "Count the servers of each upstream whose fall/(rise+fall) ratio exceeds this threshold in nginx_servers_high_fall_ratio (disabled if 0)")
+	flapDebounce     = flag.Int("nginx.flap-debounce", 0, "Number of consecutive scrapes a server must report a new state for before nginx_server_up changes (immediately if 0)")
+	metricsSubsystem = flag.String("metrics.subsystem", "", "Subsystem inserted after the nginx namespace in all metric names, e.g. tengine for nginx_tengine_raise")
+	nativeHistograms = flag.Bool("metrics.native-histograms", false, "Record the fall counts of the servers of each upstream in the native histogram nginx_server_fall_native")
+	minSuccessful    = flag.Int("metrics.min-successful-scrapes", 0, "Withhold the metrics of servers and upstreams until this many scrapes succeeded")
+	labeledUp        = flag.Bool("metrics.labeled-up", false, "Label nginx_up with the target, the scrape URI's host, even when scraping a single URI")
+	lowercaseLabels  = flag.Bool("metrics.lowercase-labels", false, "Lowercase the upstream and name label values; series differing only in case are merged")
+	nameStripPrefix  = flag.String("metrics.name-strip-prefix", "", "Strip this prefix, e.g. a Kubernetes namespace, from the name label values")
+	nameStripSuffix  = flag.String("metrics.name-strip-suffix", "", "Strip this suffix, e.g. a common domain, from the name label values")
+	authMode         = flag.String("nginx.auth", "", "Authenticate status requests: negotiate (Kerberos/SPNEGO, needs -tags spnego) or none if empty")
+	keytabPath       = flag.String("nginx.keytab", "", "Keytab holding the key of -nginx.krb5-principal for -nginx.auth=negotiate")
+	krb5Principal    = flag.String("nginx.krb5-principal", "", "Principal, as user@REALM, to authenticate as with -nginx.auth=negotiate")
+	krb5Config       = flag.String("nginx.krb5-config", "/etc/krb5.conf", "Kerberos configuration for -nginx.auth=negotiate")
+	tailMode         = flag.Bool("tail", false, "Print the servers of every target as a table each -tail.interval instead of serving metrics")
+	tailInterval     = flag.Duration("tail.interval", 5*time.Second, "Interval between scrapes with -tail")
+	errorInterval    = flag.Duration("log.error-interval", 0, "Log a scrape error identical to the previous one at most once per this interval, counting the repeats (log all if 0)")
+	pushGateway      = flag.String("push.gateway", "", "Push the metrics to the Pushgateway at this URL each -push.interval instead of serving them")
+	pushJob          = flag.String("push.job", "tengine", "Job label, the grouping key, the metrics are pushed under with -push.gateway")
+	pushJobLabel     = flag.String("push.job-label", "", "Also label every pushed metric with the -push.job under this label name, which can't be job (not labelled if empty)")
+	pushInterval     = flag.Duration("push.interval", 15*time.Second, "Interval between pushes with -push.gateway")
+	pushJitter       = flag.Duration("push.jitter", 0, "Delay all pushes by a random offset, drawn once, of up to this duration so that exporters do not push together")
+	validatePath     = flag.String("validate-file", "", "Parse the saved status body at this path, print the result and exit")
 )
 
+var nameMatchRegex regexpFlag
+
+var lastBodyRedact regexpFlag
+
+var probeAllowed regexpFlag
+
+var labelTemplate = labelsFlag{"upstream", "name"}
+
 var landingPage = []byte(`<html>
 <head><title>Nginx Exporter</title></head>
 <body>
@@ -37,130 +127,1956 @@ var landingPage = []byte(`<html>
 // Exporter collects nginx stats from the given URI and exports them using
 // the prometheus metrics package.
 type Exporter struct {
-	URI    string
-	mutex  sync.RWMutex
-	client *http.Client
+	URI             string
+	mutex           sync.RWMutex
+	client          *http.Client
+	dialer          *dialer
+	authorize       authorizer // Adds credentials to status requests if set.
+	format          string     // Of the status page: a key of parsers, reqstatFormat or stubStatusFormat.
+	parse           func(data []byte, workers int) ([]ServerStatus, []*parseError)
+	stub            *stubStatusMetrics
+	reqstat         *reqstatMetrics
+	reqstatURI      string // Scraped along with the check status page if set.
+	parseWorkers    int
+	upRequiresParse bool
+	trace           bool
+	retries         int
+	nameMatch       *regexp.Regexp
+	fallRatio       float64
+	deltas          bool
+	aggInterval     time.Duration
+	now             func() time.Time // Clock of the scrapes, for -nginx.aggregation-interval.
+	lowercase       bool
+	stripPrefix     string
+	stripSuffix     string
+	typeIdentity    bool
+	connClose       bool
+	method          string
+	noExpect        bool
+	maxRedirects    int
+	paginate        bool
+	maxBody         int64
+	maxMemory       int64
+	inventory       []inventoryServer // Of the last scrape, nil before one.
+	bodyCut         bool              // Whether the last fetch read only part of the body, under maxMemory.
+	insecure        bool
+	tlsRoots        *x509.CertPool // Checked against with insecure, system roots if nil.
+	gzip            bool
+	rawColumns      bool
+	lastBodyMax     int
+	lastBody        []byte
+	redactBody      *regexp.Regexp
+	frozen          int32 // Accessed atomically.
+	window          *scrapeWindow
+	successes       int // Successful scrapes so far.
+	minSuccesses    int // Successful scrapes before server metrics are exported.
+	cacheTTL        time.Duration
+	lastScrape      time.Time // Time of the last successful scrape.
+	errLog          *errorLog // Logs fetch errors, rate limited.
+	maxParse        time.Duration
+	circuit         *circuitBreaker
+	enabled         collectors
+	serverLabels    []string // Labels of the per-server metrics.
+
+	// reported holds the up state nginx_server_up reports for each server
+	// and pending the number of consecutive scrapes reporting the other
+	// state, for -nginx.flap-debounce, or with -nginx.aggregation-interval
+	// the intervals since the first of them.
+	flapDebounce int
+	reported     map[serverKey]bool
+	pending      map[serverKey]float64
+
+	// previous holds the servers of the last successful scrape, nil before
+	// the first one, and previousAt the time it was parsed at.
+	previous   map[serverKey]ServerStatus
+	previousAt time.Time
+	// deltaScale scales the rise/fall changes of the current scrape to
+	// -nginx.aggregation-interval, 0 if the previous scrape is too old to
+	// compare against.
+	deltaScale float64
+	// held is the time since the previous scrape in
+	// -nginx.aggregation-interval, for which the servers found in the same
+	// state by both held it; 1 without an interval.
+	held float64
 
 	error        prometheus.Gauge
+	successRatio prometheus.Gauge
+	dnsLookup    prometheus.Gauge
+	frozenGauge  prometheus.Gauge
+	retryCount   prometheus.Counter
+	retryGiveUps prometheus.Counter
+	timeDrift    prometheus.Gauge
+	hasTimeDrift bool
+	lastCollect  time.Time
+	hasInterval  bool
+	circuitOpen  prometheus.Gauge
+	configInfo   *prometheus.GaugeVec
+	interval     prometheus.Gauge
+	seriesCount  prometheus.Gauge
+	gzipRatio    prometheus.Gauge
+	cacheHits    prometheus.Counter
+	cacheMisses  prometheus.Counter
+	parseMax     prometheus.Gauge
+	lenMismatch  prometheus.Gauge
+	scrapeCost   prometheus.Gauge
+	bodyLimit    prometheus.Counter
+	rawColumn    *prometheus.GaugeVec
+	tlsFail      prometheus.Gauge
+	hasTLS       bool
+	tlsShare     prometheus.Gauge
+	hasTLSShare  bool
+	tlsResumed   prometheus.Counter
 	scrapeErrors *prometheus.CounterVec
 	nginxUp      prometheus.Gauge
+	noUpstreams  prometheus.Gauge
 	raise        *prometheus.GaugeVec
 	fail         *prometheus.GaugeVec
+	raiseTotal   *prometheus.Desc
+	failTotal    *prometheus.Desc
+	cumulative   map[string]riseFall // By joined label values, in cumulative mode.
+	downReason   *prometheus.GaugeVec
+	serverUp     *prometheus.GaugeVec
+	outages      *prometheus.CounterVec
+	connErrors   *prometheus.CounterVec
+	totalRise    prometheus.Gauge
+	totalFall    prometheus.Gauge
+	fallNative   *prometheus.HistogramVec // nil unless enabled.
+
+	upstreamServers   *prometheus.GaugeVec
+	upstreamServersUp *prometheus.GaugeVec
+	serversMatching   *prometheus.GaugeVec
+	highFallRatio     *prometheus.GaugeVec
+	upstreamWeight    *prometheus.GaugeVec
+	upstreamWeightMax *prometheus.GaugeVec
+	availability      *prometheus.GaugeVec
+	fallMax           *prometheus.GaugeVec
+	largestUpstream   *prometheus.GaugeVec
+	unknownStatus     *prometheus.GaugeVec
+	serverState       *prometheus.GaugeVec
+	checkTypes        prometheus.Gauge
+	singleServer      prometheus.Gauge
+	typeAvailability  *prometheus.GaugeVec
+	serversAdded      *prometheus.CounterVec
+	serversRemoved    *prometheus.CounterVec
+	typeChanges       *prometheus.CounterVec
+}
+
+// collectors selects the optional metric families an Exporter exports.
+type collectors struct {
+	raise     bool
+	fail      bool
+	serverUp  bool
+	upstreams bool
 }
 
 // NewExporter returns an initialized Exporter.
 func NewExporter(uri string) *Exporter {
-	return &Exporter{
-		URI: uri,
-		scrapeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+	return NewExporterWithLabels(uri, nil)
+}
+
+// upOpts returns the options of nginx_up, which with -metrics.labeled-up
+// carries a target label even if the other metrics don't.
+func upOpts(uri string, constLabels prometheus.Labels) metricOpts {
+	if !*labeledUp || constLabels["target"] != "" {
+		return metricOpts{constLabels: constLabels}
+	}
+	labels := prometheus.Labels{}
+	for name, value := range constLabels {
+		labels[name] = value
+	}
+	if u, err := url.Parse(uri); err == nil {
+		labels["target"] = u.Host
+	}
+	return metricOpts{constLabels: labels}
+}
+
+// NewExporterWithLabels returns an initialized Exporter whose metrics all
+// carry the given const labels.
+func NewExporterWithLabels(uri string, constLabels prometheus.Labels) *Exporter {
+	opts := metricOpts{constLabels: constLabels}
+	serverLabels := append([]string(nil), labelTemplate...)
+	for _, l := range []struct {
+		name    string
+		enabled bool
+	}{{"section", *sectionLabel}, {"order", *orderLabel}, {"type", *typeIdentity}} {
+		if l.enabled && !labelTemplate.has(l.name) {
+			serverLabels = append(serverLabels, l.name)
+		}
+	}
+	d := newDialer(*fallbackDelay, *preferIPv4)
+	e := &Exporter{
+		URI:             uri,
+		format:          *statusFormat,
+		parse:           parsers[*statusFormat],
+		stub:            newStubStatusMetrics(opts),
+		reqstat:         newReqstatMetrics(opts),
+		reqstatURI:      resolveURI(uri, *reqstatURI),
+		parseWorkers:    *parseWorkers,
+		upRequiresParse: *upRequiresParse,
+		trace:           *traceScrapes,
+		retries:         *scrapeRetries,
+		nameMatch:       nameMatchRegex.Regexp,
+		fallRatio:       *fallRatio,
+		deltas:          *riseFallMode == "delta",
+		aggInterval:     *aggInterval,
+		now:             time.Now,
+		lowercase:       *lowercaseLabels,
+		stripPrefix:     *nameStripPrefix,
+		stripSuffix:     *nameStripSuffix,
+		typeIdentity:    *typeIdentity,
+		flapDebounce:    *flapDebounce,
+		reported:        map[serverKey]bool{},
+		pending:         map[serverKey]float64{},
+		connClose:       *connectionClose,
+		method:          *requestMethod,
+		noExpect:        *noExpectContinue,
+		maxRedirects:    *maxRedirects,
+		paginate:        *paginate,
+		maxBody:         *maxBodyBytes,
+		maxMemory:       *maxScrapeMemory,
+		insecure:        *insecure,
+		gzip:            *requestGzip,
+		rawColumns:      *debugRawColumns,
+		lastBodyMax:     *lastBodyBytes,
+		redactBody:      lastBodyRedact.Regexp,
+		window:          newScrapeWindow(*successWindow),
+		minSuccesses:    *minSuccessful,
+		errLog:          newErrorLog(*errorInterval),
+		cacheTTL:        *cacheTTL,
+		circuit:         &circuitBreaker{threshold: *circuitFailures, cooldown: *circuitCooldown},
+		serverLabels:    serverLabels,
+		enabled: collectors{
+			raise:     *collectRaise,
+			fail:      *collectFail,
+			serverUp:  *collectServerUp,
+			upstreams: *collectUpstreams,
+		},
+		error: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "last_scrape_error",
+			Help:      "Whether the last scrape of metrics from nginx resulted in an error (1 for error, 0 for success).",
+		})),
+		successRatio: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrape_success_ratio",
+			Help:      "Ratio of successful scrapes over the last -nginx.scrape-success-window scrapes.",
+		})),
+		dnsLookup: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "dns_lookup_seconds",
+			Help:      "Time spent resolving the nginx host during the last scrape.",
+		})),
+		tlsShare: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "tls_handshake_fraction",
+			Help:      "Fraction of the last status request of an https target spent in the TLS handshake.",
+		})),
+		tlsResumed: prometheus.NewCounter(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "tls_resumed_total",
+			Help:      "Number of TLS handshakes with an https target that resumed a previous session.",
+		})),
+		frozenGauge: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "frozen",
+			Help:      "Whether scraping is frozen and the last metrics are served.",
+		})),
+		retryCount: prometheus.NewCounter(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrape_retries_total",
+			Help:      "Number of retried status requests.",
+		})),
+		retryGiveUps: prometheus.NewCounter(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrape_retry_exhausted_total",
+			Help:      "Number of scrapes that failed after using all retries.",
+		})),
+		timeDrift: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "target_time_drift_seconds",
+			Help:      "Difference between the clock of nginx, from the Date header of its last response, and the exporter's clock.",
+		})),
+		circuitOpen: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "circuit_open",
+			Help:      "Whether scrapes are skipped after -nginx.circuit-failures consecutive failures (1 while open or half-open).",
+		})),
+		interval: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "observed_scrape_interval_seconds",
+			Help:      "Time between the last two collects of the metrics.",
+		})),
+		seriesCount: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "series_count",
+			Help:      "Number of series of the server and upstream metrics exported by the last collect.",
+		})),
+		configInfo: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "config_info",
+			Help:      "Scrape policy the exporter is configured with, as labels; the value is always 1.",
+		}), []string{"timeout_seconds", "retries", "insecure"}),
+		gzipRatio: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "response_decompression_ratio",
+			Help:      "Ratio of the decompressed to the compressed size of the last compressed status body.",
+		})),
+		tlsFail: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "tls_would_fail_verification",
+			Help:      "Whether the certificate of the last https status response, ignored with -insecure, would fail verification (1 if it would, 0 otherwise).",
+		})),
+		bodyLimit: prometheus.NewCounter(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "body_limit_hits_total",
+			Help:      "Number of status bodies longer than -nginx.max-body-bytes.",
+		})),
+		rawColumn: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "raw_column",
+			Help:      "Columns of the first server line of the last status body, by position; the value is always 1.",
+		}), []string{"col", "value"}),
+		scrapeCost: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrape_cost",
+			Help:      "Servers parsed by the last scrape times the average length of its status lines in bytes, a rough measure of its workload.",
+		})),
+		lenMismatch: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "content_length_mismatch",
+			Help:      "Whether the last status body was not as long as its Content-Length header (1 if it was not, 0 otherwise).",
+		})),
+		parseMax: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "parse_duration_max_seconds",
+			Help:      "Longest time parsing a status body took since start or the last reset on the admin address.",
+		})),
+		cacheHits: prometheus.NewCounter(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "cache_hits_total",
+			Help:      "Number of collects served from the metrics of the last scrape, within -nginx.cache-ttl.",
+		})),
+		cacheMisses: prometheus.NewCounter(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "cache_misses_total",
+			Help:      "Number of collects that scraped nginx because -nginx.cache-ttl had passed.",
+		})),
+		scrapeErrors: prometheus.NewCounterVec(opts.counter(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: exporter,
 			Name:      "scrape_errors_total",
-			Help: "Number 	of errors while scraping nginx.",
-		}, []string{"collector"}),
-		nginxUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Help:      "Number 	of errors while scraping nginx.",
+		}), []string{"collector"}),
+		nginxUp: prometheus.NewGauge(upOpts(uri, constLabels).gauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "up",
 			Help:      "Whether the Nginx server is up.",
-		}),
-		raise: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		})),
+		noUpstreams: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "no_upstreams",
+			Help:      "Whether the last status was parsed without errors but listed no upstream.",
+		})),
+		raise: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "raise",
 			Help:      "Number of raise status.",
-		}, []string{"upstream", "name", "status"}),
-		fail: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		}), serverLabels),
+		fail: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "fail",
 			Help:      "Number of fail status.",
-		}, []string{"upstream", "name", "status"}),
+		}), serverLabels),
+		serverUp: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "server_up",
+			Help:      "Whether the check reports the server up.",
+		}), serverLabels),
+		outages: prometheus.NewCounterVec(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "server_outages_total",
+			Help:      "Number of times the check reported the server down after reporting it up the scrape before.",
+		}), serverLabels),
+		connErrors: prometheus.NewCounterVec(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "server_conn_errors_total",
+			Help:      "Number of connection errors tengine reported for the server, if its status has a conn_errors column.",
+		}), serverLabels),
+		raiseTotal: opts.desc(prometheus.Opts{
+			Namespace: namespace,
+			Name:      "raise_total",
+			Help:      "Rise count of the server as reported by tengine, reset by reloads.",
+		}, serverLabels),
+		failTotal: opts.desc(prometheus.Opts{
+			Namespace: namespace,
+			Name:      "fail_total",
+			Help:      "Fall count of the server as reported by tengine, reset by reloads.",
+		}, serverLabels),
+		downReason: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "server_down_reason_info",
+			Help:      "Reason reported by tengine for a server being down.",
+		}), append(append([]string(nil), serverLabels...), "reason")),
+		upstreamServers: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstream_servers",
+			Help:      "Number of servers in the upstream.",
+		}), []string{"upstream"}),
+		upstreamServersUp: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstream_servers_up",
+			Help:      "Number of servers in the upstream the check reports up.",
+		}), []string{"upstream"}),
+		serversMatching: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "servers_matching",
+			Help:      "Number of servers in the upstream whose name matches -nginx.name-match-regex.",
+		}), []string{"upstream"}),
+		highFallRatio: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "servers_high_fall_ratio",
+			Help:      "Number of servers in the upstream whose fall/(rise+fall) ratio exceeds -nginx.fall-ratio-threshold.",
+		}), []string{"upstream"}),
+		upstreamWeight: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstream_weight_total",
+			Help:      "Sum of the weights of the servers in the upstream, if the status reports weights.",
+		}), []string{"upstream"}),
+		upstreamWeightMax: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstream_weight_max",
+			Help:      "Largest weight of a server in the upstream, if the status reports weights.",
+		}), []string{"upstream"}),
+		availability: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstream_availability_ratio",
+			Help:      "Ratio of the servers in the upstream the check reports up.",
+		}), []string{"upstream"}),
+		fallMax: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstream_fall_max",
+			Help:      "Highest fall count of a server in the upstream.",
+		}), []string{"upstream"}),
+		largestUpstream: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "largest_upstream_info",
+			Help:      "Upstream with the most servers, the first by name on ties; the value is its number of servers.",
+		}), []string{"upstream"}),
+		unknownStatus: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "servers_unknown_status",
+			Help:      "Number of servers in the upstream whose status is neither up nor down.",
+		}), []string{"upstream"}),
+		serverState: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstream_server_state",
+			Help:      "Number of servers in the upstream in each state: up, down, draining, or unknown for any other status.",
+		}), []string{"upstream", "state"}),
+		singleServer: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "upstreams_single_server",
+			Help:      "Number of upstreams with exactly one server, without redundancy.",
+		})),
+		totalRise: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "total_rise",
+			Help:      "Sum of the rise counts of all servers, as exported by nginx_raise.",
+		})),
+		totalFall: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "total_fall",
+			Help:      "Sum of the fall counts of all servers, as exported by nginx_fail.",
+		})),
+		checkTypes: prometheus.NewGauge(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "check_types_count",
+			Help:      "Number of distinct check types of the servers.",
+		})),
+		typeAvailability: prometheus.NewGaugeVec(opts.gauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "check_type_availability_ratio",
+			Help:      "Ratio of the servers of the check type the check reports up.",
+		}), []string{"type"}),
+		serversAdded: prometheus.NewCounterVec(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_servers_added_total",
+			Help:      "Number of servers that appeared in the upstream between scrapes.",
+		}), []string{"upstream"}),
+		serversRemoved: prometheus.NewCounterVec(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_servers_removed_total",
+			Help:      "Number of servers that disappeared from the upstream between scrapes.",
+		}), []string{"upstream"}),
+		typeChanges: prometheus.NewCounterVec(opts.counter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "servers_check_type_changed_total",
+			Help:      "Number of times a server of the upstream was reported with another check type than the scrape before.",
+		}), []string{"upstream"}),
+		dialer: d,
 		client: &http.Client{
+			Timeout: *scrapeTimeout,
 			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure},
+				DialContext: d.DialContext,
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: *insecure,
+					// Resume sessions to spare a full handshake when
+					// connections are reopened.
+					ClientSessionCache: tls.NewLRUClientSessionCache(0),
+				},
+				// Don't wait for 100 Continue even if Expect is set.
+				ExpectContinueTimeout: 0,
 			},
 		},
 	}
+	e.client.CheckRedirect = e.checkRedirect
+	if *nativeHistograms {
+		e.fallNative = prometheus.NewHistogramVec(opts.histogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "server_fall_native",
+			Help:      "Fall counts of the servers in the upstream, observed every scrape.",
+			// A factor above 1 makes this a native histogram without
+			// classic buckets.
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  160,
+			NativeHistogramMinResetDuration: time.Hour,
+		}), []string{"upstream"})
+	}
+	e.configInfo.WithLabelValues(
+		strconv.FormatFloat(e.client.Timeout.Seconds(), 'g', -1, 64),
+		strconv.Itoa(e.retries),
+		strconv.FormatBool(*insecure),
+	).Set(1)
+	e.SetFrozen(*freeze)
+	return e
 }
 
 // Describe describes all the metrics ever exported by the nginx exporter. It
 // implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	e.nginxUp.Describe(ch)
-	e.raise.Describe(ch)
-	e.fail.Describe(ch)
+	e.noUpstreams.Describe(ch)
+	if e.enabled.raise {
+		e.raise.Describe(ch)
+		if !e.deltas {
+			ch <- e.raiseTotal
+		}
+	}
+	if e.enabled.fail {
+		e.fail.Describe(ch)
+		if !e.deltas {
+			ch <- e.failTotal
+		}
+	}
+	if e.enabled.serverUp {
+		e.serverUp.Describe(ch)
+	}
+	e.downReason.Describe(ch)
+	e.outages.Describe(ch)
+	e.connErrors.Describe(ch)
+	e.totalRise.Describe(ch)
+	e.totalFall.Describe(ch)
+	if e.fallNative != nil {
+		e.fallNative.Describe(ch)
+	}
+	if e.enabled.upstreams {
+		e.upstreamServers.Describe(ch)
+		e.upstreamServersUp.Describe(ch)
+		e.upstreamWeight.Describe(ch)
+		e.upstreamWeightMax.Describe(ch)
+		e.availability.Describe(ch)
+		e.fallMax.Describe(ch)
+		e.largestUpstream.Describe(ch)
+		e.unknownStatus.Describe(ch)
+		e.serverState.Describe(ch)
+		e.singleServer.Describe(ch)
+		e.serversAdded.Describe(ch)
+		e.serversRemoved.Describe(ch)
+		e.typeChanges.Describe(ch)
+	}
+	e.serversMatching.Describe(ch)
+	e.highFallRatio.Describe(ch)
+	e.checkTypes.Describe(ch)
+	e.typeAvailability.Describe(ch)
 	e.scrapeErrors.Describe(ch)
+	e.error.Describe(ch)
+	e.successRatio.Describe(ch)
+	e.dnsLookup.Describe(ch)
+	e.tlsShare.Describe(ch)
+	e.tlsResumed.Describe(ch)
+	e.frozenGauge.Describe(ch)
+	e.retryCount.Describe(ch)
+	e.retryGiveUps.Describe(ch)
+	e.timeDrift.Describe(ch)
+	e.circuitOpen.Describe(ch)
+	e.configInfo.Describe(ch)
+	e.interval.Describe(ch)
+	e.seriesCount.Describe(ch)
+	e.gzipRatio.Describe(ch)
+	e.parseMax.Describe(ch)
+	e.lenMismatch.Describe(ch)
+	e.scrapeCost.Describe(ch)
+	e.bodyLimit.Describe(ch)
+	if e.rawColumns {
+		e.rawColumn.Describe(ch)
+	}
+	e.tlsFail.Describe(ch)
+	e.cacheHits.Describe(ch)
+	e.cacheMisses.Describe(ch)
+	e.stub.describe(ch)
+	e.reqstat.describe(ch)
 }
 
 // Collect fetches the stats from configured nginx location and delivers them
 // as Prometheus metrics. It implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.scrape(ch)
-	e.raise.Collect(ch)
-	e.fail.Collect(ch)
+	e.mutex.Lock() // To protect metrics from concurrent collects.
+	defer e.mutex.Unlock()
+
+	now := time.Now()
+	if !e.lastCollect.IsZero() {
+		e.interval.Set(now.Sub(e.lastCollect).Seconds())
+		e.hasInterval = true
+	}
+	e.lastCollect = now
+
+	if e.Frozen() {
+		e.frozenGauge.Set(1)
+	} else if e.cacheTTL > 0 && !e.lastScrape.IsZero() && now.Sub(e.lastScrape) < e.cacheTTL {
+		e.frozenGauge.Set(0)
+		e.cacheHits.Inc()
+	} else {
+		e.frozenGauge.Set(0)
+		if e.cacheTTL > 0 {
+			e.cacheMisses.Inc()
+		}
+		if err := e.scrape(ch); err != nil {
+			e.error.Set(1)
+			e.window.add(false)
+		} else {
+			e.error.Set(0)
+			e.window.add(true)
+			e.successes++
+			e.lastScrape = now
+		}
+		e.successRatio.Set(e.window.ratio())
+	}
+
+	if e.successes >= e.minSuccesses {
+		e.seriesCount.Set(float64(e.collectServers(ch)))
+	} else {
+		e.seriesCount.Set(0)
+	}
+	ch <- e.seriesCount
+	ch <- e.parseMax
+	ch <- e.lenMismatch
+	ch <- e.scrapeCost
 	e.scrapeErrors.Collect(ch)
+	e.configInfo.Collect(ch)
+	ch <- e.error
+	ch <- e.successRatio
+	ch <- e.frozenGauge
+	ch <- e.retryCount
+	ch <- e.retryGiveUps
+	if e.hasTimeDrift {
+		ch <- e.timeDrift
+	}
+	if e.hasTLS {
+		ch <- e.tlsFail
+	}
+	if e.hasInterval {
+		ch <- e.interval
+	}
+	if e.trace {
+		ch <- e.dnsLookup
+		if e.hasTLSShare {
+			ch <- e.tlsShare
+			ch <- e.tlsResumed
+		}
+	}
+	if e.circuit.threshold > 0 {
+		ch <- e.circuitOpen
+	}
+	if e.gzip {
+		ch <- e.gzipRatio
+	}
+	if e.maxBody > 0 {
+		ch <- e.bodyLimit
+	}
+	if e.rawColumns {
+		e.rawColumn.Collect(ch)
+	}
+	if e.cacheTTL > 0 {
+		ch <- e.cacheHits
+		ch <- e.cacheMisses
+	}
 	ch <- e.nginxUp
+	ch <- e.noUpstreams
 }
 
-func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
-	resp, err := e.client.Get(e.URI)
+// collectServers delivers the metrics derived from the status page, its
+// server lines or module counts, and returns their number.
+func (e *Exporter) collectServers(out chan<- prometheus.Metric) int {
+	// Relay the metrics to out, counting them on the way. The count is
+	// buffered so that the relay ends even if collecting panics and
+	// nobody receives it.
+	ch := make(chan prometheus.Metric)
+	n := make(chan int, 1)
+	atomic.AddInt64(&scrapeGoroutines, 1)
+	go func() {
+		defer atomic.AddInt64(&scrapeGoroutines, -1)
+		count := 0
+		for m := range ch {
+			out <- m
+			count++
+		}
+		n <- count
+	}()
+
+	func() {
+		defer close(ch)
+		switch e.format {
+		case stubStatusFormat:
+			e.stub.collect(ch)
+		case reqstatFormat:
+			e.reqstat.collect(ch)
+		default:
+			e.collectChecks(ch)
+			if e.reqstatURI != "" {
+				e.reqstat.collect(ch)
+			}
+		}
+	}()
+	return <-n
+}
+
+// collectChecks delivers the metrics derived from the server lines.
+func (e *Exporter) collectChecks(ch chan<- prometheus.Metric) {
+	if e.enabled.raise {
+		e.raise.Collect(ch)
+	}
+	if e.enabled.fail {
+		e.fail.Collect(ch)
+	}
+	for _, c := range e.cumulative {
+		if e.enabled.raise {
+			ch <- prometheus.MustNewConstMetric(e.raiseTotal, prometheus.CounterValue, float64(c.rise), c.labels...)
+		}
+		if e.enabled.fail {
+			ch <- prometheus.MustNewConstMetric(e.failTotal, prometheus.CounterValue, float64(c.fall), c.labels...)
+		}
+	}
+	if e.enabled.serverUp {
+		e.serverUp.Collect(ch)
+	}
+	e.downReason.Collect(ch)
+	e.outages.Collect(ch)
+	e.connErrors.Collect(ch)
+	ch <- e.totalRise
+	ch <- e.totalFall
+	if e.fallNative != nil {
+		e.fallNative.Collect(ch)
+	}
+	if e.enabled.upstreams {
+		e.upstreamServers.Collect(ch)
+		e.upstreamServersUp.Collect(ch)
+		e.upstreamWeight.Collect(ch)
+		e.upstreamWeightMax.Collect(ch)
+		e.availability.Collect(ch)
+		e.fallMax.Collect(ch)
+		e.largestUpstream.Collect(ch)
+		e.unknownStatus.Collect(ch)
+		e.serverState.Collect(ch)
+		ch <- e.singleServer
+		e.serversAdded.Collect(ch)
+		e.serversRemoved.Collect(ch)
+		e.typeChanges.Collect(ch)
+	}
+	e.serversMatching.Collect(ch)
+	e.highFallRatio.Collect(ch)
+	ch <- e.checkTypes
+	e.typeAvailability.Collect(ch)
+}
+
+// setFormat makes e read status pages in format from the next scrape on.
+func (e *Exporter) setFormat(format string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.format = format
+	e.parse = parsers[format]
+}
+
+// ResetParseDurationMax forgets the longest parse duration observed so far.
+func (e *Exporter) ResetParseDurationMax() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.maxParse = 0
+	e.parseMax.Set(0)
+}
+
+// SetFrozen stops or resumes scraping. While frozen, Collect serves the
+// metrics of the last scrape.
+func (e *Exporter) SetFrozen(frozen bool) {
+	var v int32
+	if frozen {
+		v = 1
+	}
+	atomic.StoreInt32(&e.frozen, v)
+}
+
+// Frozen reports whether scraping is frozen.
+func (e *Exporter) Frozen() bool {
+	return atomic.LoadInt32(&e.frozen) == 1
+}
+
+func (e *Exporter) scrape(ch chan<- prometheus.Metric) error {
+	if !e.circuit.allow(time.Now()) {
+		log.Debugf("Circuit open, skipping scrape of %s", redactURI(e.URI))
+		e.nginxUp.Set(0)
+		e.noUpstreams.Set(0)
+		return errCircuitOpen
+	}
+	buf, err := e.fetch()
+	// A body over the limit would be as long again, so it isn't retried.
+	retry := !errors.Is(err, errBodyLimit)
+	for attempt := 1; err != nil && retry && attempt <= e.retries; attempt++ {
+		log.Infof("Retrying nginx status request (%d/%d)", attempt, e.retries)
+		e.retryCount.Inc()
+		buf, err = e.fetch()
+	}
+	wasOpen := e.circuit.open()
+	e.circuit.record(err == nil, time.Now())
+	if e.circuit.open() {
+		if !wasOpen {
+			log.Warnf("Opening circuit for %s after %d failed scrapes", redactURI(e.URI), e.circuit.failures)
+		}
+		e.circuitOpen.Set(1)
+	} else {
+		e.circuitOpen.Set(0)
+	}
 	if err != nil {
-		log.Errorln("Error calling nginx status API: ", err)
+		if e.retries > 0 && retry {
+			e.retryGiveUps.Inc()
+		}
 		e.nginxUp.Set(0)
+		e.noUpstreams.Set(0)
+		return err
 	}
+	e.nginxUp.Set(1)
 
-	data, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		if err != nil {
-			data = []byte(err.Error())
+	// Parse once; every metric family is derived from the same records.
+	// The servers don't refer to the body, which goes back to the pool.
+	data := buf.Bytes()
+	capped := e.bodyCut
+	if e.maxMemory > 0 {
+		var cut bool
+		data, cut = capBody(data, e.maxMemory)
+		capped = capped || cut
+	}
+	if capped {
+		e.errLog.Warnf("Parsing the first %d status bytes, more would exceed -nginx.max-scrape-memory", len(data))
+		e.scrapeErrors.WithLabelValues("memory_cap").Inc()
+		if e.format == "json" {
+			// A JSON document cut short doesn't parse at all: keep
+			// the metrics of the last scrape.
+			putBuffer(buf)
+			return nil
 		}
-		log.Warnf("Status %s (%d): %s", resp.Status, resp.StatusCode, data)
+	}
+	if e.rawColumns {
+		e.setRawColumns(data)
+	}
+	if e.format == stubStatusFormat || e.format == reqstatFormat {
+		e.scrapeModule(data)
+		putBuffer(buf)
+		return nil
+	}
+	size, lines := len(data), bytes.Count(bytes.TrimRight(data, "\n"), []byte("\n"))+1
+	start := time.Now()
+	servers, errs := e.parse(data, e.parseWorkers)
+	if d := time.Since(start); d > e.maxParse {
+		e.maxParse = d
+		e.parseMax.Set(d.Seconds())
+	}
+	putBuffer(buf)
+	for _, err := range errs {
+		log.Errorln("Error parsing status: ", err)
+		e.scrapeErrors.WithLabelValues(err.Field).Inc()
+	}
+	e.inventory = newInventory(servers)
+	if e.lowercase {
+		for i := range servers {
+			servers[i].Upstream = strings.ToLower(servers[i].Upstream)
+			servers[i].Name = strings.ToLower(servers[i].Name)
+		}
+	}
+	if e.stripPrefix != "" || e.stripSuffix != "" {
+		e.stripNames(servers)
+	}
+	if !e.typeIdentity {
+		servers = e.dedupeTypes(servers)
+	}
+	if len(servers) == 0 && len(errs) == 0 {
+		e.noUpstreams.Set(1)
+	} else {
+		e.noUpstreams.Set(0)
+	}
+	if e.upRequiresParse && len(servers) == 0 {
+		log.Warnln("No server could be parsed from nginx status, reporting nginx down")
 		e.nginxUp.Set(0)
 	}
+	if capped {
+		// The servers past the cap are unknown, not gone: keep their
+		// last states rather than delete their series.
+		servers = e.withPrevious(servers)
+	} else {
+		e.countMembershipChanges(servers)
+	}
+	now := e.now()
+	e.deltaScale = e.aggregationScale(now)
+	e.held = e.intervalsSince(now)
+	e.updateServers(servers)
+	e.updateUpstreams(servers)
 
-	e.nginxUp.Set(1)
+	e.previous = make(map[serverKey]ServerStatus, len(servers))
+	for _, s := range servers {
+		e.previous[e.key(s)] = s
+	}
+	e.previousAt = now
+	e.scrapeCost.Set(scrapeCost(len(servers), size, lines))
+	if e.reqstatURI != "" {
+		e.scrapeReqstat()
+	}
+	return nil
+}
+
+// scrapeReqstat exports the reqstat page at e.reqstatURI along with the
+// check metrics. The check scrape succeeds without it: a failure is counted
+// as a reqstat scrape error and drops the nginx_reqstat_* series.
+func (e *Exporter) scrapeReqstat() {
+	buf, _, err := e.fetchPage(e.reqstatURI)
+	if err != nil {
+		e.errLog.Errorf("Error scraping reqstat page %s: %s", redactURI(e.reqstatURI), err)
+		e.scrapeErrors.WithLabelValues(reqstatFormat).Inc()
+		e.reqstat.set(nil)
+		return
+	}
+	zones, errs := parseReqstat(buf.Bytes())
+	putBuffer(buf)
+	for _, err := range errs {
+		log.Errorln("Error parsing reqstat page: ", err)
+		e.scrapeErrors.WithLabelValues(err.Field).Inc()
+	}
+	e.reqstat.set(zones)
+}
+
+// resolveURI returns ref resolved against base, "" if ref is, and ref
+// itself if either doesn't parse, to fail when it is requested.
+func resolveURI(base, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return b.ResolveReference(r).String()
+}
+
+// scrapeModule exports the counts of a stub_status or reqstat page, which
+// list no servers.
+func (e *Exporter) scrapeModule(data []byte) {
+	var (
+		errs   []*parseError
+		parsed bool
+	)
+	if e.format == stubStatusFormat {
+		var s stubStatus
+		s, errs = parseStubStatus(data)
+		parsed = len(errs) == 0
+		e.stub.set(s, parsed)
+	} else {
+		var zones []reqstatZone
+		zones, errs = parseReqstat(data)
+		parsed = len(zones) > 0
+		e.reqstat.set(zones)
+	}
+	for _, err := range errs {
+		log.Errorln("Error parsing status: ", err)
+		e.scrapeErrors.WithLabelValues(err.Field).Inc()
+	}
+	e.noUpstreams.Set(0)
+	if e.upRequiresParse && !parsed {
+		log.Warnln("Nothing could be parsed from nginx status, reporting nginx down")
+		e.nginxUp.Set(0)
+	}
+}
 
-	// Parsing results
-	lines := strings.Split(string(data), "\n")
+// scrapeCost returns the number of servers parsed times the average length
+// of the size bytes of a status body made of lines.
+func scrapeCost(servers, size, lines int) float64 {
+	if lines == 0 {
+		return 0
+	}
+	return float64(servers) * float64(size) / float64(lines)
+}
 
-	for _, line := range lines {
-		if len(line) <= 0 {
+// setRawColumns sets nginx_exporter_raw_column to the comma-separated
+// columns of the first line of data that isn't empty, a comment or a header.
+// Only one line is exported to bound the cardinality.
+func (e *Exporter) setRawColumns(data []byte) {
+	e.rawColumn.Reset()
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" || isComment(line) || isHeader(line) {
 			continue
 		}
-		cols := strings.Split(line, ",")
-		upstream := cols[1]
-		name := cols[2]
-		status := cols[3]
-		raise := cols[4]
-		fail := cols[5]
-		raiseCount, err := strconv.Atoi(raise)
+		for i, col := range strings.Split(line, ",") {
+			e.rawColumn.WithLabelValues(strconv.Itoa(i), col).Set(1)
+		}
+		return
+	}
+}
+
+// errTooManyRedirects is returned by status requests redirected more than
+// -nginx.max-redirects times, most likely in a loop.
+var errTooManyRedirects = errors.New("too many redirects")
+
+// checkRedirect is the CheckRedirect of e's client.
+func (e *Exporter) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > e.maxRedirects {
+		return fmt.Errorf("%w: stopped after %d, last to %s", errTooManyRedirects, e.maxRedirects, redactURI(req.URL.String()))
+	}
+	return nil
+}
+
+// verifyPeer verifies the certificate chain of state as the client would
+// without InsecureSkipVerify, against roots or the system roots if nil.
+func verifyPeer(state *tls.ConnectionState, host string, roots *x509.CertPool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// fetch retrieves the status body from the configured URI, and with
+// -nginx.paginate the pages following it, concatenated. The caller returns
+// the buffer holding it with putBuffer.
+func (e *Exporter) fetch() (*bytes.Buffer, error) {
+	e.bodyCut = false
+	buf, header, err := e.fetchPage(e.URI)
+	if err != nil || !e.paginate {
+		return buf, err
+	}
+	current := e.URI
+	for page := 2; ; page++ {
+		next, err := nextPage(e.URI, current, header, page)
 		if err != nil {
-			log.Errorln("Error parsing raise count: ", err)
-			e.scrapeErrors.WithLabelValues("raise").Inc()
+			putBuffer(buf)
+			e.errLog.Errorf("Error paginating nginx status: %s", err)
+			return nil, err
+		}
+		if next == "" {
+			return buf, nil
+		}
+		var pageBuf *bytes.Buffer
+		if pageBuf, header, err = e.fetchPage(next); err != nil {
+			putBuffer(buf)
+			return nil, err
+		}
+		current = next
+		if b := buf.Bytes(); len(b) > 0 && b[len(b)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		buf.Write(pageBuf.Bytes())
+		putBuffer(pageBuf)
+	}
+}
+
+// maxPages bounds the pages of a paginated status, against servers linking
+// pages in a loop.
+const maxPages = 1000
+
+// nextPage returns the URI of page of the status at uri, "" if the page at
+// current, returned with header, was the last. A Link header with
+// rel="next", resolved against current, takes precedence over an
+// X-Total-Pages header counting the pages, which are then requested with a
+// page query parameter.
+func nextPage(uri, current string, header http.Header, page int) (string, error) {
+	if page > maxPages {
+		return "", fmt.Errorf("more than %d pages", maxPages)
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	for _, link := range header.Values("Link") {
+		for _, l := range strings.Split(link, ",") {
+			parts := strings.Split(l, ";")
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, param := range parts[1:] {
+				if param = strings.TrimSpace(param); param == `rel="next"` || param == "rel=next" {
+					next, err := base.Parse(target)
+					if err != nil {
+						return "", fmt.Errorf("invalid next page link %q: %s", target, err)
+					}
+					return next.String(), nil
+				}
+			}
+		}
+	}
+	if total := header.Get("X-Total-Pages"); total != "" {
+		n, err := strconv.Atoi(total)
+		if err != nil {
+			return "", fmt.Errorf("invalid X-Total-Pages %q: %s", total, err)
+		}
+		if page > n {
+			return "", nil
+		}
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", err
+		}
+		q := u.Query()
+		q.Set("page", strconv.Itoa(page))
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+	return "", nil
+}
+
+// fetchPage retrieves the status body at uri, returning the response
+// headers along with it. The caller returns the buffer with putBuffer.
+func (e *Exporter) fetchPage(uri string) (*bytes.Buffer, http.Header, error) {
+	req, err := http.NewRequest(e.method, uri, nil)
+	if err != nil {
+		e.errLog.Errorf("Error creating nginx status request: %s", err)
+		return nil, nil, err
+	}
+	req.Close = e.connClose
+	if e.gzip {
+		// Setting the header ourselves keeps the transport from
+		// decompressing transparently, hiding the compressed size.
+		req.Header.Set("Accept-Encoding", acceptEncoding())
+	}
+	if e.authorize != nil {
+		if err := e.authorize(req); err != nil {
+			e.errLog.Errorf("Error authenticating nginx status request: %s", err)
+			return nil, nil, err
+		}
+	}
+	if e.noExpect {
+		// Some servers mishandle the header; the transport never adds it
+		// itself, but an authorizer might.
+		req.Header.Del("Expect")
+	}
+	var trace *scrapeTrace
+	if e.trace {
+		trace = &scrapeTrace{}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace()))
+	}
+
+	resp, err := e.client.Do(req)
+	if trace != nil {
+		e.dnsLookup.Set(trace.dnsLookup().Seconds())
+	}
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			e.errLog.Errorf("Error resolving nginx host %s: %s", dnsErr.Name, dnsErr.Err)
+			e.scrapeErrors.WithLabelValues("dns").Inc()
+			return nil, nil, err
+		}
+		if errors.Is(err, errTooManyRedirects) {
+			e.scrapeErrors.WithLabelValues("redirect_loop").Inc()
+		}
+		e.errLog.Errorf("Error calling nginx status API: %s", err)
+		return nil, nil, err
+	}
+
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		e.timeDrift.Set(date.Sub(time.Now()).Seconds())
+		e.hasTimeDrift = true
+	}
+	if e.insecure && resp.TLS != nil {
+		if err := verifyPeer(resp.TLS, resp.Request.URL.Hostname(), e.tlsRoots); err != nil {
+			log.Debugf("Certificate of %s would fail verification: %s", redactURI(e.URI), err)
+			e.tlsFail.Set(1)
 		} else {
-			e.raise.WithLabelValues(upstream, name, status).Set(float64(raiseCount))
+			e.tlsFail.Set(0)
 		}
+		e.hasTLS = true
+	}
 
-		failCount, err := strconv.Atoi(fail)
+	// Parsing is projected to take at least twice the body, so no more
+	// than half of -nginx.max-scrape-memory of it is read.
+	buf, compressed, err := readBody(resp, e.maxBody, e.maxMemory/2)
+	if errors.Is(err, errBodyCut) {
+		e.bodyCut = true
+		err = nil
+	}
+	resp.Body.Close()
+	if trace != nil && resp.TLS != nil {
+		e.tlsShare.Set(trace.tlsHandshakeFraction(time.Now()))
+		e.hasTLSShare = true
+		if trace.resumed {
+			e.tlsResumed.Inc()
+		}
+	}
+	// A body cut short, e.g. by a proxy, ends reading with an error, but
+	// the mismatch tells truncation apart from other read errors. A body
+	// over the limit or cut under the memory cap is left unread, so its
+	// length is unknown.
+	received := int64(buf.Len())
+	if compressed > 0 {
+		received = int64(compressed)
+	}
+	if errors.Is(err, errBodyLimit) {
+		e.bodyLimit.Inc()
+		e.lenMismatch.Set(0)
+	} else if e.bodyCut {
+		e.lenMismatch.Set(0)
+	} else if resp.ContentLength >= 0 && received != resp.ContentLength {
+		e.errLog.Warnf("Status body of %d bytes differs from its Content-Length of %d", received, resp.ContentLength)
+		e.lenMismatch.Set(1)
+	} else {
+		e.lenMismatch.Set(0)
+	}
+	if err == nil && compressed > 0 {
+		e.gzipRatio.Set(float64(buf.Len()) / float64(compressed))
+	}
+	if e.lastBodyMax > 0 {
+		e.keepBody(buf.Bytes())
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		msg := buf.String()
 		if err != nil {
-			log.Errorln("Error parsing fail count: ", err)
-			e.scrapeErrors.WithLabelValues("fail").Inc()
-		} else if failCount != 0 {
-			e.raise.WithLabelValues(upstream, name, status).Set(float64(failCount))
+			msg = err.Error()
 		}
+		putBuffer(buf)
+		e.errLog.Warnf("Status %s (%d): %s", resp.Status, resp.StatusCode, msg)
+		return nil, nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err != nil {
+		putBuffer(buf)
+		e.errLog.Errorf("Error reading nginx status body: %s", err)
+		return nil, nil, err
+	}
+	return buf, resp.Header, nil
+}
+
+// redacted replaces the matches of -web.debug-last-body-redact.
+const redacted = "[REDACTED]"
+
+// keepBody stores up to lastBodyMax bytes of data for LastBody, with the
+// matches of -web.debug-last-body-redact redacted. The whole body is
+// redacted before it is cut, so that no secret is kept half-matched.
+func (e *Exporter) keepBody(data []byte) {
+	if e.redactBody != nil {
+		data = e.redactBody.ReplaceAll(data, []byte(redacted))
+	}
+	if len(data) > e.lastBodyMax {
+		data = data[:e.lastBodyMax]
+	}
+	e.lastBody = append([]byte{}, data...)
+}
+
+// LastBody returns the stored body of the last scrape, and whether there is
+// one.
+func (e *Exporter) LastBody() ([]byte, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if e.lastBody == nil {
+		return nil, false
+	}
+	return append([]byte(nil), e.lastBody...), true
+}
+
+// inventoryServer is a server listed by /-/inventory on the admin address.
+type inventoryServer struct {
+	Upstream string `json:"upstream"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+}
+
+// Inventory returns the servers of the last successful scrape, whatever
+// their state, sorted by upstream, name and type, and whether there was one.
+func (e *Exporter) Inventory() ([]inventoryServer, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.inventory, e.inventory != nil
+}
+
+// newInventory returns the inventory of servers as parsed, before any
+// transformation of their names or merging of duplicates, so that every
+// (upstream, name, type) listed by tengine is in it.
+func newInventory(servers []ServerStatus) []inventoryServer {
+	inventory := make([]inventoryServer, 0, len(servers))
+	seen := make(map[inventoryServer]bool, len(servers))
+	for _, s := range servers {
+		if i := (inventoryServer{s.Upstream, s.Name, s.Type}); !seen[i] {
+			seen[i] = true
+			inventory = append(inventory, i)
+		}
+	}
+	sort.Slice(inventory, func(i, j int) bool {
+		a, b := inventory[i], inventory[j]
+		if a.Upstream != b.Upstream {
+			return a.Upstream < b.Upstream
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Type < b.Type
+	})
+	return inventory
+}
+
+// updateServers sets the per-server metrics. Their series are identified by
+// upstream and name only, so that they survive status changes, and the
+// series of servers that disappeared are deleted rather than resetting the
+// metrics.
+func (e *Exporter) updateServers(servers []ServerStatus) {
+	e.downReason.Reset()
+	e.cumulative = nil
+	if !e.deltas {
+		e.cumulative = make(map[string]riseFall, len(servers))
+	}
+	seen := make(map[serverKey]bool, len(servers))
+	current := make(map[string]bool, len(servers))
+	var totalRise, totalFall float64
+	for _, s := range servers {
+		seen[e.key(s)] = true
+		labels := e.serverLabelValues(s)
+		current[strings.Join(labels, "\xff")] = true
+		if e.cumulative != nil {
+			e.cumulative[strings.Join(labels, "\xff")] = riseFall{labels, s.Rise, s.Fall}
+		}
+		if e.debounce(e.key(s), s.Status == "up") {
+			e.serverUp.WithLabelValues(labels...).Set(1)
+		} else {
+			e.serverUp.WithLabelValues(labels...).Set(0)
+		}
+		outages := e.outages.WithLabelValues(labels...)
+		// Past maxAggregationGap, the previous state is too old to tell
+		// outages apart, as before the first scrape.
+		if prev, ok := e.previous[e.key(s)]; ok && e.deltaScale > 0 && prev.Status == "up" && s.Status == "down" {
+			outages.Inc()
+		}
+		if s.ConnErrors >= 0 {
+			// Add the increase since the previous scrape, or the whole
+			// count after tengine reset it, keeping the counter monotonic.
+			inc := s.ConnErrors
+			if prev, ok := e.previous[e.key(s)]; ok && prev.ConnErrors >= 0 && s.ConnErrors >= prev.ConnErrors {
+				inc -= prev.ConnErrors
+			}
+			e.connErrors.WithLabelValues(labels...).Add(float64(inc))
+		} else {
+			e.connErrors.DeleteLabelValues(labels...)
+		}
+		if s.Status == "down" && s.Reason != "" {
+			e.downReason.WithLabelValues(e.serverLabelValues(s, s.Reason)...).Set(1)
+		}
+		rise, fall := float64(s.Rise), float64(s.Fall)
+		if e.deltas {
+			prev, ok := e.previous[e.key(s)]
+			ok = ok && e.deltaScale > 0
+			rise = float64(delta(prev.Rise, s.Rise, ok)) * e.deltaScale
+			fall = float64(delta(prev.Fall, s.Fall, ok)) * e.deltaScale
+		}
+		totalRise += rise
+		totalFall += fall
+		e.raise.WithLabelValues(labels...).Set(rise)
+		if e.fallNative != nil {
+			e.fallNative.WithLabelValues(s.Upstream).Observe(float64(s.Fall))
+		}
+		if s.Fall != 0 {
+			e.fail.WithLabelValues(labels...).Set(fall)
+		} else {
+			e.fail.DeleteLabelValues(labels...)
+		}
+	}
+	e.totalRise.Set(totalRise)
+	e.totalFall.Set(totalFall)
+	for _, prev := range e.previous {
+		labels := e.serverLabelValues(prev)
+		if !current[strings.Join(labels, "\xff")] {
+			e.serverUp.DeleteLabelValues(labels...)
+			e.outages.DeleteLabelValues(labels...)
+			e.connErrors.DeleteLabelValues(labels...)
+			e.raise.DeleteLabelValues(labels...)
+			e.fail.DeleteLabelValues(labels...)
+		}
+	}
+	for k := range e.reported {
+		if !seen[k] {
+			delete(e.reported, k)
+			delete(e.pending, k)
+		}
+	}
+}
+
+// debounce returns the up state to report for the server k currently
+// reported up or down, which only changes once the server held the new state
+// for flapDebounce consecutive scrapes. With an aggregation interval, it
+// must have held it for flapDebounce intervals from the first scrape finding
+// it: the server may have changed just before, so that scrape adds nothing,
+// however late it comes.
+func (e *Exporter) debounce(k serverKey, up bool) bool {
+	reported, ok := e.reported[k]
+	if !ok || reported == up {
+		e.reported[k] = up
+		delete(e.pending, k)
+		return up
+	}
+	_, ok = e.pending[k]
+	if ok || e.aggInterval <= 0 {
+		e.pending[k] += e.held
+	} else {
+		e.pending[k] = 0
+	}
+	if e.pending[k] < float64(e.flapDebounce) {
+		return reported
+	}
+	e.reported[k] = up
+	delete(e.pending, k)
+	return up
+}
+
+// key returns the key identifying s, which includes its check type with
+// -metrics.type-in-identity.
+func (e *Exporter) key(s ServerStatus) serverKey {
+	k := s.key()
+	if e.typeIdentity {
+		k.typ = s.Type
+	}
+	return k
+}
+
+// stripNames strips -metrics.name-strip-prefix and -metrics.name-strip-suffix
+// from the names of servers, leaving names that would be stripped empty
+// alone. Servers of an upstream whose names become the same share their
+// series, which is warned about.
+func (e *Exporter) stripNames(servers []ServerStatus) {
+	stripped := make(map[serverKey]string, len(servers))
+	for i := range servers {
+		s := &servers[i]
+		orig := s.Name
+		if name := strings.TrimSuffix(strings.TrimPrefix(s.Name, e.stripPrefix), e.stripSuffix); name != "" {
+			s.Name = name
+		}
+		if other, ok := stripped[s.key()]; ok && other != orig {
+			e.errLog.Warnf("Servers %s and %s of upstream %s are both named %s once stripped, their series are merged", other, orig, s.Upstream, s.Name)
+			continue
+		}
+		stripped[s.key()] = orig
+	}
+}
+
+// dedupeTypes drops the servers reported again in their upstream with
+// another check type, which would share their series, keeping the first.
+// Servers repeated with the same type are left alone.
+func (e *Exporter) dedupeTypes(servers []ServerStatus) []ServerStatus {
+	types := make(map[serverKey]string, len(servers))
+	kept := servers[:0]
+	for _, s := range servers {
+		typ, ok := types[s.key()]
+		if ok && typ != s.Type {
+			e.errLog.Warnf("Server %s of upstream %s reported with check types %s and %s, keeping %s", s.Name, s.Upstream, typ, s.Type, typ)
+			continue
+		}
+		types[s.key()] = s.Type
+		kept = append(kept, s)
+	}
+	return kept
+}
+
+// serverLabelValues returns the values of the per-server labels of s
+// followed by the given values of any extra labels.
+func (e *Exporter) serverLabelValues(s ServerStatus, extra ...string) []string {
+	values := make([]string, 0, len(e.serverLabels)+len(extra))
+	for _, l := range e.serverLabels {
+		switch l {
+		case "upstream":
+			values = append(values, s.Upstream)
+		case "name":
+			values = append(values, s.Name)
+		case "section":
+			values = append(values, strconv.Itoa(s.Section))
+		case "type":
+			values = append(values, s.Type)
+		case "weight":
+			values = append(values, strconv.Itoa(s.Weight))
+		case "order":
+			// Servers without an index, e.g. from the kv format, get an
+			// empty order.
+			order := ""
+			if s.Index >= 0 {
+				order = strconv.Itoa(s.Index)
+			}
+			values = append(values, order)
+		}
+	}
+	return append(values, extra...)
+}
+
+// maxAggregationGap is the number of -nginx.aggregation-interval a scrape
+// may come after the previous one for the rise/fall changes between them to
+// be scaled. Past it, so many scrapes were missed that scaling would smear
+// a reload or an outage over the gap, and no change is reported as after
+// the first scrape.
+const maxAggregationGap = 10
+
+// aggregationScale returns the factor scaling the rise/fall changes between
+// the previous scrape and one at now to -nginx.aggregation-interval: below 1
+// if the scrape is late or scrapes were missed, and 1 if it is early. It is
+// 1 without an aggregation interval or previous scrape, and 0 if the
+// previous scrape is more than maxAggregationGap intervals old.
+func (e *Exporter) aggregationScale(now time.Time) float64 {
+	if e.aggInterval <= 0 || e.previousAt.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(e.previousAt)
+	switch {
+	case elapsed <= 0:
+		// A clock step back leaves nothing to scale by.
+		return 1
+	case elapsed < e.aggInterval:
+		// An early scrape reports its change as is: scaling it up
+		// would extrapolate a burst to the whole interval.
+		return 1
+	case elapsed > maxAggregationGap*e.aggInterval:
+		return 0
+	}
+	return e.aggInterval.Seconds() / elapsed.Seconds()
+}
+
+// intervalsSince returns the -nginx.aggregation-interval elapsed from the
+// previous scrape to now: 1 without an interval, and 0 without a previous
+// scrape, time elapsed, or if the previous scrape is more than
+// maxAggregationGap intervals old.
+func (e *Exporter) intervalsSince(now time.Time) float64 {
+	if e.aggInterval <= 0 {
+		return 1
+	}
+	elapsed := now.Sub(e.previousAt)
+	if e.previousAt.IsZero() || elapsed <= 0 || elapsed > maxAggregationGap*e.aggInterval {
+		// Past maxAggregationGap, the states in between are unknown,
+		// as for the rise/fall changes.
+		return 0
+	}
+	return elapsed.Seconds() / e.aggInterval.Seconds()
+}
+
+// riseFall holds the rise and fall counts of the server with the given
+// label values.
+type riseFall struct {
+	labels     []string
+	rise, fall int
+}
+
+// delta returns the increase from prev to cur. A decrease means tengine
+// reset its counters, e.g. on reload, and cur counts from zero. Without a
+// previous value there is no increase to report yet.
+func delta(prev, cur int, hasPrev bool) int {
+	switch {
+	case !hasPrev:
+		return 0
+	case cur < prev:
+		return cur
+	default:
+		return cur - prev
+	}
+}
+
+// serverStates are the states of nginx_upstream_server_state.
+var serverStates = []string{"up", "down", "draining", "unknown"}
+
+// stateOf returns the state of nginx_upstream_server_state for status.
+func stateOf(status string) string {
+	switch status {
+	case "up", "down", "draining":
+		return status
+	}
+	return "unknown"
+}
+
+// updateUpstreams sets the metrics aggregated per upstream.
+func (e *Exporter) updateUpstreams(servers []ServerStatus) {
+	e.upstreamServers.Reset()
+	e.upstreamServersUp.Reset()
+	e.serversMatching.Reset()
+	e.highFallRatio.Reset()
+	e.upstreamWeight.Reset()
+	e.upstreamWeightMax.Reset()
+	e.availability.Reset()
+	e.fallMax.Reset()
+	e.largestUpstream.Reset()
+	e.unknownStatus.Reset()
+	e.serverState.Reset()
+	e.typeAvailability.Reset()
+	maxWeight, maxFall := map[string]int{}, map[string]int{}
+	total, upCount := map[string]int{}, map[string]int{}
+	typeTotal, typeUp := map[string]int{}, map[string]int{}
+	for _, s := range servers {
+		if s.Type != "" {
+			typeTotal[s.Type]++
+			if s.Status == "up" {
+				typeUp[s.Type]++
+			}
+		}
+		e.upstreamServers.WithLabelValues(s.Upstream).Inc()
+		up := e.upstreamServersUp.WithLabelValues(s.Upstream)
+		total[s.Upstream]++
+		unknown := e.unknownStatus.WithLabelValues(s.Upstream)
+		if s.Status != "up" && s.Status != "down" {
+			unknown.Inc()
+		}
+		// Every state is exported, if only as 0.
+		for _, state := range serverStates {
+			e.serverState.WithLabelValues(s.Upstream, state)
+		}
+		e.serverState.WithLabelValues(s.Upstream, stateOf(s.Status)).Inc()
+		if f, ok := maxFall[s.Upstream]; !ok || s.Fall > f {
+			maxFall[s.Upstream] = s.Fall
+			e.fallMax.WithLabelValues(s.Upstream).Set(float64(s.Fall))
+		}
+		if s.Status == "up" {
+			up.Inc()
+			upCount[s.Upstream]++
+		}
+		if e.nameMatch != nil {
+			matching := e.serversMatching.WithLabelValues(s.Upstream)
+			if e.nameMatch.MatchString(s.Name) {
+				matching.Inc()
+			}
+		}
+		if e.fallRatio > 0 {
+			high := e.highFallRatio.WithLabelValues(s.Upstream)
+			// A server without any check yet has no ratio.
+			if n := s.Rise + s.Fall; n > 0 && float64(s.Fall)/float64(n) > e.fallRatio {
+				high.Inc()
+			}
+		}
+		if s.Weight > 0 {
+			e.upstreamWeight.WithLabelValues(s.Upstream).Add(float64(s.Weight))
+			if s.Weight > maxWeight[s.Upstream] {
+				maxWeight[s.Upstream] = s.Weight
+				e.upstreamWeightMax.WithLabelValues(s.Upstream).Set(float64(s.Weight))
+			}
+		}
+	}
+	e.checkTypes.Set(float64(len(typeTotal)))
+	for typ, n := range typeTotal {
+		e.typeAvailability.WithLabelValues(typ).Set(float64(typeUp[typ]) / float64(n))
+	}
+	largest, single := "", 0
+	for upstream, n := range total {
+		if n == 1 {
+			single++
+		}
+		if n > total[largest] || n == total[largest] && upstream < largest {
+			largest = upstream
+		}
+		// Upstreams are only known from their servers, so n is never 0;
+		// guard against it anyway rather than export NaN.
+		if n > 0 {
+			e.availability.WithLabelValues(upstream).Set(float64(upCount[upstream]) / float64(n))
+		}
+	}
+	e.singleServer.Set(float64(single))
+	if largest != "" {
+		e.largestUpstream.WithLabelValues(largest).Set(float64(total[largest]))
+	}
+}
+
+// withPrevious returns servers, parsed from part of a status body, followed
+// by the servers of the previous scrape it leaves out, in key order.
+func (e *Exporter) withPrevious(servers []ServerStatus) []ServerStatus {
+	parsed := make(map[serverKey]bool, len(servers))
+	for _, s := range servers {
+		parsed[e.key(s)] = true
+	}
+	var rest []ServerStatus
+	for k, s := range e.previous {
+		if !parsed[k] {
+			rest = append(rest, s)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		a, b := e.key(rest[i]), e.key(rest[j])
+		if a.upstream != b.upstream {
+			return a.upstream < b.upstream
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.typ < b.typ
+	})
+	return append(servers, rest...)
+}
+
+// countMembershipChanges counts the servers added to and removed from each
+// upstream since the previous scrape, and those whose check type changed.
+// With -metrics.type-in-identity a server changing its type is counted as
+// removed and added instead.
+func (e *Exporter) countMembershipChanges(servers []ServerStatus) {
+	if e.previous == nil {
+		return
+	}
+	current := make(map[serverKey]bool, len(servers))
+	for _, s := range servers {
+		current[e.key(s)] = true
+		prev, ok := e.previous[e.key(s)]
+		if !ok {
+			e.serversAdded.WithLabelValues(s.Upstream).Inc()
+		} else if prev.Type != s.Type {
+			e.typeChanges.WithLabelValues(s.Upstream).Inc()
+		}
+	}
+	for k := range e.previous {
+		if !current[k] {
+			e.serversRemoved.WithLabelValues(k.upstream).Inc()
+		}
+	}
+}
+
+// heartbeat counts the gathers of the registry it is registered with,
+// independently of the state of the scraped targets.
+type heartbeat struct {
+	mutex   sync.Mutex
+	desc    *prometheus.Desc
+	count   float64
+	created time.Time
+}
+
+func newHeartbeat() *heartbeat {
+	opts := prometheus.Opts{
+		Namespace: namespace,
+		Subsystem: exporter,
+		Name:      "heartbeat",
+		Help:      "Number of times the exporter's metrics were gathered.",
+	}
+	metricOpts{}.apply(&opts)
+	return &heartbeat{
+		desc:    prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, nil, nil),
+		created: time.Now(),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (h *heartbeat) Describe(ch chan<- *prometheus.Desc) {
+	ch <- h.desc
+}
+
+// Collect implements prometheus.Collector.
+func (h *heartbeat) Collect(ch chan<- prometheus.Metric) {
+	h.mutex.Lock()
+	h.count++
+	count := h.count
+	h.mutex.Unlock()
+	ch <- prometheus.MustNewConstMetricWithCreatedTimestamp(h.desc, prometheus.CounterValue, count, h.created)
+}
+
+// scrapeWindow is a ring buffer of the outcomes of the most recent scrapes.
+type scrapeWindow struct {
+	results []bool
+	next    int
+	count   int
+}
+
+func newScrapeWindow(size int) *scrapeWindow {
+	if size < 1 {
+		size = 1
+	}
+	return &scrapeWindow{results: make([]bool, size)}
+}
+
+func (w *scrapeWindow) add(success bool) {
+	w.results[w.next] = success
+	w.next = (w.next + 1) % len(w.results)
+	if w.count < len(w.results) {
+		w.count++
+	}
+}
+
+// ratio returns the fraction of successful scrapes in the window.
+func (w *scrapeWindow) ratio() float64 {
+	if w.count == 0 {
+		return 0
+	}
+	ok := 0
+	for i := 0; i < w.count; i++ {
+		if w.results[i] {
+			ok++
+		}
+	}
+	return float64(ok) / float64(w.count)
+}
+
+// requireTargets exits unless every target of m can be scraped, for
+// -nginx.fail-closed-on-startup.
+func requireTargets(m *MultiExporter) {
+	for _, e := range m.targets() {
+		buf, err := e.fetch()
+		if err != nil {
+			log.Fatalf("Error scraping %s at startup: %s", redactURI(e.URI), err)
+		}
+		putBuffer(buf)
 	}
 }
 
 func main() {
+	flag.Var(metricHelp, "metric.help", "Override the help text of a metric as name=text (repeatable)")
+	flag.Var(&nameMatchRegex, "nginx.name-match-regex", "Count the servers of each upstream whose name matches this regular expression")
+	flag.Var(&probeAllowed, "web.probe-allowed-targets", "Only probe the targets whose host:port this regular expression matches in full, and send -nginx.auth credentials to them (any target, without credentials, if unset)")
+	flag.Var(&lastBodyRedact, "web.debug-last-body-redact", "Replace the matches of this regular expression with "+redacted+" in the bodies kept for /debug/last-body")
+	flag.Var(&labelTemplate, "metrics.label-template", "Comma-separated server fields labelling the per-server metrics, of "+strings.Join(serverLabelFields, ", "))
 	flag.Parse()
+	if err := applyEnv(flag.CommandLine, envPrefix, os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+	if !validFormat(*statusFormat) {
+		log.Fatalf("Invalid -nginx.format %q, must be csv, json, kv, reqstat or stub_status", *statusFormat)
+	}
+	if *requestMethod != "GET" && *requestMethod != "POST" {
+		log.Fatalf("Invalid -nginx.method %q, must be GET or POST", *requestMethod)
+	}
+	if *riseFallMode != "cumulative" && *riseFallMode != "delta" {
+		log.Fatalf("Invalid -nginx.rise-fall-mode %q, must be cumulative or delta", *riseFallMode)
+	}
+	if *fallRatio < 0 || *fallRatio >= 1 {
+		log.Fatalf("Invalid -nginx.fall-ratio-threshold %v, must be at least 0 and below 1", *fallRatio)
+	}
+	if *pushJobLabel == "job" {
+		log.Fatalf("Invalid -push.job-label %q, the Pushgateway sets the job label itself", *pushJobLabel)
+	}
+	if *aggInterval < 0 {
+		log.Fatalf("Invalid -nginx.aggregation-interval %s, must not be negative", *aggInterval)
+	}
+	if err := validateSubsystem(*metricsSubsystem); err != nil {
+		log.Fatal(err)
+	}
 
-	exporter := NewExporter(*nginxScrapeURI)
-	prometheus.MustRegister(exporter)
+	if *validatePath != "" {
+		os.Exit(validateFile(*validatePath, os.Stdout))
+	}
+
+	var (
+		exporter *MultiExporter
+		err      error
+	)
+	switch {
+	case *targetsFile != "":
+		if exporter, err = NewFileExporter(*targetsFile); err != nil {
+			log.Fatal(err)
+		}
+		if *targetsReload > 0 {
+			go exporter.reloadTargets(*targetsFile, *targetsReload, nil)
+		}
+	case *srvRecord != "":
+		d, err := newSRVDiscovery(*srvRecord, *nginxScrapeURI)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if exporter, err = NewSRVExporter(d); err != nil {
+			log.Fatal(err)
+		}
+		go exporter.rediscover(d, *srvInterval)
+	default:
+		if exporter, err = NewMultiExporter(strings.Split(*nginxScrapeURI, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := metricHelp.validate(); err != nil {
+		log.Fatal(err)
+	}
+	authorize, err := newAuthorizer(*authMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	exporter.setAuthorizer(authorize)
+	if *failClosed {
+		requireTargets(exporter)
+	}
+	if *tailMode {
+		tail(exporter, os.Stdout, *tailInterval, 0)
+		return
+	}
+	multiTarget := exporter.dynamic || len(exporter.targets()) > 1
+	if *pushGateway != "" {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(exporter, newHeartbeat(), newFeaturesInfo(multiTarget))
+		offset := pushOffset(*pushJitter, rand.New(rand.NewSource(time.Now().UnixNano())))
+		log.Infof("Pushing to %s as job %s every %s, offset by %s", *pushGateway, *pushJob, *pushInterval, offset)
+		pushLoop(newPusher(*pushGateway, *pushJob, *pushJobLabel, reg), time.Now(), *pushInterval, offset, 0)
+		return
+	}
+	prometheus.MustRegister(exporter, newHeartbeat(), newFeaturesInfo(multiTarget))
 
-	http.Handle(*metricsEndpoint, promhttp.Handler())
+	var nets []*net.IPNet
+	if *allowedCIDRs != "" {
+		if nets, err = parseCIDRs(*allowedCIDRs); err != nil {
+			log.Fatalf("Invalid -web.allowed-cidrs: %s", err)
+		}
+	}
+	allow := func(h http.Handler) http.Handler {
+		if nets == nil {
+			return h
+		}
+		return ipAllowlist(nets, *trustXFF, h)
+	}
+	http.Handle(*metricsEndpoint, allow(promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		metricsHandler(prometheus.DefaultGatherer, *createdSamples),
+	)))
+	if *probePath != "" {
+		http.Handle(*probePath, allow(probeHandler(*probeTimeout, authorize, probeAllowed.Regexp)))
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write(landingPage)
 	})
 
+	if *adminAddress != "" {
+		go func() {
+			log.Infoln("Admin endpoints listening on", *adminAddress)
+			log.Fatal(http.ListenAndServe(*adminAddress, adminHandler(exporter)))
+		}()
+	}
+
 	log.Infoln("Listening on", *listeningAddress)
 	log.Fatal(http.ListenAndServe(*listeningAddress, nil))
 }
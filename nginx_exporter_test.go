@@ -1,11 +1,20 @@
 package main
 
 import (
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 const (
@@ -15,8 +24,37 @@ const (
 3,us2,10.1.0.4:80,up,8247,0,tcp,0
 4,us2,10.1.0.5:80,up,7918,0,tcp,0
 `
-	// 5 status and 1 up
-	metricCount = 6
+	nginxStatusWithReasons = `0,us1,10.1.0.1:80,up,8247,0,tcp,0,
+1,us1,10.1.0.2:80,down,0,3,tcp,0,connect timeout
+2,us2,10.1.0.3:80,down,0,5,http,0,bad status code
+3,us2,10.1.0.4:80,down,0,1,http,0
+`
+	nginxStatusSections = `0,us1,10.1.0.1:80,up,8247,0,tcp,0
+1,us1,10.1.0.2:80,down,0,3,tcp,0
+
+upstream,name,status,fall,rise
+us3,10.2.0.1:80,up,0,120
+us3,10.2.0.2:80,up,0,118
+`
+	nginxStatusWeights = `upstream,name,status,rise,fall,weight
+us1,10.1.0.1:80,up,8247,0,5
+us1,10.1.0.2:80,up,8251,0,1
+us2,10.1.0.3:80,up,8251,0,2
+us2,10.1.0.4:80,up,8247,0,2
+`
+	nginxStatusConnErrors = `index,upstream,name,status,rise,fall,type,port,conn_errors
+0,us1,10.1.0.1:80,up,8247,0,tcp,0,0
+1,us1,10.1.0.2:80,down,0,3,tcp,0,17
+2,us2,10.1.0.3:80,up,8251,0,tcp,0,4
+`
+	// 5 raise, 2x5 raise/fail counters, 5 server up, 5 outages, 2
+	// rise/fall totals, 2x5 upstream aggregates, 2x4 upstream server
+	// states, 1 single server upstreams, 1 up, 1 no upstreams, 1 last
+	// scrape error, 1 success ratio, 1 frozen, 2 retry counters, 1 time
+	// drift, 1 config info, 1 check types count, 1 check type
+	// availability, 1 largest upstream, 1 series count, 1 parse duration
+	// max, 1 content length mismatch and 1 scrape cost
+	metricCount = 62
 )
 
 func TestNginxStatus(t *testing.T) {
@@ -43,3 +81,1529 @@ func TestNginxStatus(t *testing.T) {
 		t.Error("expected closed channel")
 	}
 }
+
+func TestScrapeFetchesOnce(t *testing.T) {
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+
+	if requests != 1 {
+		t.Errorf("expected 1 status request per collect, got %d", requests)
+	}
+	if v, _ := seriesValue(mfs, "nginx_raise", "upstream", "us2", "name", "10.1.0.5:80"); v != 7918 {
+		t.Errorf("got raise %v, want 7918", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_upstream_servers", "upstream", "us2"); v != 3 {
+		t.Errorf("got %v servers in us2, want 3", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_upstream_servers_up", "upstream", "us1"); v != 2 {
+		t.Errorf("got %v servers up in us1, want 2", v)
+	}
+	// 5 raise, 2x5 raise/fail counters, 5 server up, 5 outages, 2
+	// rise/fall totals, 2x5 upstream aggregates, 2x4 upstream server
+	// states, 1 single server upstreams, 1 largest upstream, 1 check types
+	// count and 1 check type availability.
+	if v, _ := seriesValue(mfs, "nginx_exporter_series_count"); v != 49 {
+		t.Errorf("got series count %v, want 49", v)
+	}
+}
+
+func TestReqstatAlongsideChecks(t *testing.T) {
+	requests := map[string]int{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/status":
+			w.Write([]byte(nginxStatus))
+		case "/req_status":
+			w.Write([]byte(reqstatPage))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	*reqstatURI = "/req_status"
+	defer func() { *reqstatURI = "" }()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL + "/status"))
+	mfs := gather(t, reg)
+
+	if requests["/status"] != 1 || requests["/req_status"] != 1 {
+		t.Errorf("expected one request per page, got %v", requests)
+	}
+	if v, _ := seriesValue(mfs, "nginx_raise", "upstream", "us2", "name", "10.1.0.5:80"); v != 7918 {
+		t.Errorf("got raise %v, want 7918", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_reqstat_bytes_in_total", "key", "www.example.com"); v != 7936 {
+		t.Errorf("got %v reqstat bytes in, want 7936", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_upstream_servers", "upstream", "us2"); v != 3 {
+		t.Errorf("got %v servers in us2, want 3", v)
+	}
+	for name, mf := range mfs {
+		reqstat := strings.HasPrefix(name, "nginx_reqstat_")
+		for _, m := range mf.GetMetric() {
+			keyed := false
+			for _, lp := range m.GetLabel() {
+				keyed = keyed || lp.GetName() == "key"
+			}
+			if keyed != reqstat {
+				t.Errorf("%s: reqstat and check series mixed up in one family", name)
+				break
+			}
+		}
+	}
+
+	// The check metrics outlive a failed reqstat scrape.
+	*reqstatURI = "/missing"
+	e := NewExporter(server.URL + "/status")
+	reg = prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs = gather(t, reg)
+	if _, ok := mfs["nginx_reqstat_bytes_in_total"]; ok {
+		t.Error("expected no reqstat series after a failed reqstat scrape")
+	}
+	if v, _ := seriesValue(mfs, "nginx_up"); v != 1 {
+		t.Errorf("got up %v, want 1", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_exporter_scrape_errors_total", "collector", "reqstat"); v != 1 {
+		t.Errorf("got %v reqstat scrape errors, want 1", v)
+	}
+}
+
+func TestUpRequiresParse(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><body>Welcome to tengine!</body></html>\n"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		requireParse bool
+		want         float64
+	}{
+		{false, 1},
+		{true, 0},
+	} {
+		e := NewExporter(server.URL)
+		e.upRequiresParse = tt.requireParse
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(e)
+
+		if got, _ := seriesValue(gather(t, reg), "nginx_up"); got != tt.want {
+			t.Errorf("up-requires-parse=%v: got nginx_up %v, want %v", tt.requireParse, got, tt.want)
+		}
+	}
+}
+
+func TestAggregationInterval(t *testing.T) {
+	var rise int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "0,us1,10.1.0.1:80,up,%d,0,tcp,0\n", rise)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	e := NewExporter(server.URL)
+	e.deltas = true
+	e.aggInterval = 15 * time.Second
+	e.now = func() time.Time { return now }
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	// tengine counts 10 rises a second; the scrapes come on time, early,
+	// which isn't scaled up, late, on time, after a missed one, and after
+	// so many missed that the change isn't scaled.
+	for _, tt := range []struct {
+		at   time.Duration
+		want float64
+	}{
+		{0, 0},
+		{15 * time.Second, 150},
+		{20 * time.Second, 50},
+		{40 * time.Second, 150},
+		{55 * time.Second, 150},
+		{85 * time.Second, 150},
+		{85*time.Second + 10*15*time.Second + time.Second, 0},
+		{85*time.Second + 10*15*time.Second + 16*time.Second, 150},
+	} {
+		now = start.Add(tt.at)
+		rise = 10 * int(tt.at/time.Second)
+		if v, _ := seriesValue(gather(t, reg), "nginx_raise", "name", "10.1.0.1:80"); v != tt.want {
+			t.Errorf("scrape at %s: got raise %v, want %v", tt.at, v, tt.want)
+		}
+	}
+}
+
+func TestNoUpstreams(t *testing.T) {
+	for _, tt := range []struct {
+		body string
+		want float64
+	}{
+		{"\n\n\n", 1},
+		{nginxStatus, 0},
+		{"<html><body>Welcome to tengine!</body></html>\n", 0},
+	} {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(tt.body))
+		})
+		server := httptest.NewServer(handler)
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(NewExporter(server.URL))
+		mfs := gather(t, reg)
+		server.Close()
+
+		if v, _ := seriesValue(mfs, "nginx_up"); v != 1 {
+			t.Errorf("%q: got nginx_up %v, want 1", tt.body, v)
+		}
+		if v, _ := seriesValue(mfs, "nginx_no_upstreams"); v != tt.want {
+			t.Errorf("%q: got nginx_no_upstreams %v, want %v", tt.body, v, tt.want)
+		}
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.retries = 2
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	for i := 1; i <= 2; i++ {
+		mfs := gather(t, reg)
+		if v, _ := seriesValue(mfs, "nginx_exporter_scrape_retry_exhausted_total"); v != float64(i) {
+			t.Errorf("collect %d: got %v exhausted retries, want %d", i, v, i)
+		}
+		if v, _ := seriesValue(mfs, "nginx_exporter_scrape_retries_total"); v != float64(2*i) {
+			t.Errorf("collect %d: got %v retries, want %d", i, v, 2*i)
+		}
+	}
+	if requests != 6 {
+		t.Errorf("expected 6 requests, got %d", requests)
+	}
+}
+
+func TestPostWithoutExpectContinue(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("got method %s, want POST", r.Method)
+		}
+		if v := r.Header.Get("Expect"); v != "" {
+			t.Errorf("unexpected Expect: %s", v)
+		}
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.method = "POST"
+	e.authorize = func(req *http.Request) error {
+		req.Header.Set("Expect", "100-continue")
+		return nil
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	if v, _ := seriesValue(gather(t, reg), "nginx_up"); v != 1 {
+		t.Errorf("got nginx_up %v, want 1", v)
+	}
+}
+
+func TestDNSError(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter("http://nginx.invalid/status"))
+	mfs := gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_exporter_scrape_errors_total", "collector", "dns"); v != 1 {
+		t.Errorf("got %v dns errors, want 1", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_up"); v != 0 {
+		t.Errorf("got nginx_up %v, want 0", v)
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	var requests int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL + "/status")
+	e.maxRedirects = 3
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+	if requests != 4 {
+		t.Errorf("expected the request and 3 redirects, got %d requests", requests)
+	}
+	if v, _ := seriesValue(mfs, "nginx_exporter_scrape_errors_total", "collector", "redirect_loop"); v != 1 {
+		t.Errorf("got %v redirect loop errors, want 1", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_up"); v != 0 {
+		t.Errorf("got nginx_up %v, want 0", v)
+	}
+}
+
+func TestTLSWouldFailVerification(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_up"); v != 1 {
+		t.Fatalf("got nginx_up %v, want 1 under -insecure", v)
+	}
+	if v, ok := seriesValue(mfs, "nginx_exporter_tls_would_fail_verification"); !ok || v != 1 {
+		t.Errorf("got %v for a self-signed certificate, want 1", v)
+	}
+
+	e.tlsRoots = x509.NewCertPool()
+	e.tlsRoots.AddCert(server.Certificate())
+	if v, _ := seriesValue(gather(t, reg), "nginx_exporter_tls_would_fail_verification"); v != 0 {
+		t.Errorf("got %v for a trusted certificate, want 0", v)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	lines := strings.SplitAfter(nginxStatus, "\n")
+	pages := []string{strings.Join(lines[:2], ""), strings.Join(lines[2:5], "")}
+	for name, paginate := range map[string]func(w http.ResponseWriter, r *http.Request){
+		"link": func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("page") == "" {
+				w.Header().Set("Link", `</status?page=2>; rel="next"`)
+				w.Write([]byte(strings.TrimSuffix(pages[0], "\n")))
+				return
+			}
+			w.Write([]byte(pages[1]))
+		},
+		"total pages": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Total-Pages", "2")
+			if r.URL.Query().Get("page") == "2" {
+				w.Write([]byte(pages[1]))
+				return
+			}
+			w.Write([]byte(pages[0]))
+		},
+	} {
+		var requests int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			paginate(w, r)
+		}))
+
+		e := NewExporter(server.URL + "/status")
+		e.paginate = true
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(e)
+		mfs := gather(t, reg)
+		server.Close()
+
+		if requests != 2 {
+			t.Errorf("%s: expected 2 page requests, got %d", name, requests)
+		}
+		for upstream, want := range map[string]float64{"us1": 2, "us2": 3} {
+			if v, _ := seriesValue(mfs, "nginx_upstream_servers", "upstream", upstream); v != want {
+				t.Errorf("%s: got %v servers in %s, want %v", name, v, upstream, want)
+			}
+		}
+		if _, ok := seriesValue(mfs, "nginx_exporter_scrape_errors_total"); ok {
+			t.Errorf("%s: unexpected scrape errors", name)
+		}
+	}
+}
+
+func TestFailClosedOnStartup(t *testing.T) {
+	if uri := os.Getenv("FAIL_CLOSED_URI"); uri != "" {
+		m, err := NewMultiExporter([]string{uri})
+		if err != nil {
+			t.Fatal(err)
+		}
+		requireTargets(m)
+		return
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	// Nothing listens on a closed server's address.
+	unreachable := httptest.NewServer(handler)
+	unreachable.Close()
+
+	for uri, wantExit := range map[string]bool{server.URL: false, unreachable.URL: true} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestFailClosedOnStartup$")
+		cmd.Env = append(os.Environ(), "FAIL_CLOSED_URI="+uri)
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if wantExit && !errors.As(err, &exitErr) || !wantExit && err != nil {
+			t.Errorf("%s: got %v, want a non-zero exit %v", uri, err, wantExit)
+		}
+	}
+}
+
+func TestServersMatching(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	var re regexpFlag
+	if err := re.Set(`^10\.1\.0\.[1-3]:`); err != nil {
+		t.Fatal(err)
+	}
+	e.nameMatch = re.Regexp
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+
+	for upstream, want := range map[string]float64{"us1": 2, "us2": 1} {
+		if v, ok := seriesValue(mfs, "nginx_servers_matching", "upstream", upstream); !ok || v != want {
+			t.Errorf("%s: got %v matching servers, want %v", upstream, v, want)
+		}
+	}
+	if err := re.Set("(unclosed"); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL), newHeartbeat())
+
+	for i := 1; i <= 2; i++ {
+		mfs := gather(t, reg)
+		if v, _ := seriesValue(mfs, "nginx_up"); v != 0 {
+			t.Fatalf("expected failing backend, got nginx_up %v", v)
+		}
+		if v, _ := seriesValue(mfs, "nginx_exporter_heartbeat"); v != float64(i) {
+			t.Errorf("gather %d: got heartbeat %v, want %d", i, v, i)
+		}
+	}
+}
+
+func TestRiseFallMode(t *testing.T) {
+	bodies := []string{
+		"0,us1,10.1.0.1:80,up,10,0,tcp,0\n1,us1,10.1.0.2:80,down,0,100,tcp,0\n",
+		// 10.1.0.2 counters were reset by a reload.
+		"0,us1,10.1.0.1:80,up,15,0,tcp,0\n1,us1,10.1.0.2:80,down,0,3,tcp,0\n",
+	}
+	for _, tt := range []struct {
+		deltas             bool
+		wantRise, wantFall []float64
+	}{
+		{false, []float64{10, 15}, []float64{100, 3}},
+		{true, []float64{0, 5}, []float64{0, 3}},
+	} {
+		scrape := 0
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(bodies[scrape]))
+		})
+		server := httptest.NewServer(handler)
+
+		e := NewExporter(server.URL)
+		e.deltas = tt.deltas
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(e)
+		for scrape = range bodies {
+			mfs := gather(t, reg)
+			if v, _ := seriesValue(mfs, "nginx_raise", "name", "10.1.0.1:80"); v != tt.wantRise[scrape] {
+				t.Errorf("deltas=%v scrape %d: got raise %v, want %v", tt.deltas, scrape+1, v, tt.wantRise[scrape])
+			}
+			if v, _ := seriesValue(mfs, "nginx_fail", "name", "10.1.0.2:80"); v != tt.wantFall[scrape] {
+				t.Errorf("deltas=%v scrape %d: got fail %v, want %v", tt.deltas, scrape+1, v, tt.wantFall[scrape])
+			}
+			// The raw counts are also counters in cumulative mode only.
+			for _, name := range []string{"nginx_raise_total", "nginx_fail_total"} {
+				mf, ok := mfs[name]
+				if ok == tt.deltas {
+					t.Errorf("deltas=%v scrape %d: %s exported %v", tt.deltas, scrape+1, name, ok)
+				} else if ok && mf.GetType() != dto.MetricType_COUNTER {
+					t.Errorf("scrape %d: %s has type %v, want counter", scrape+1, name, mf.GetType())
+				}
+			}
+			if !tt.deltas {
+				if v, _ := seriesValue(mfs, "nginx_raise_total", "name", "10.1.0.1:80"); v != tt.wantRise[scrape] {
+					t.Errorf("scrape %d: got raise total %v, want %v", scrape+1, v, tt.wantRise[scrape])
+				}
+				if v, _ := seriesValue(mfs, "nginx_fail_total", "name", "10.1.0.2:80"); v != tt.wantFall[scrape] {
+					t.Errorf("scrape %d: got fail total %v, want %v", scrape+1, v, tt.wantFall[scrape])
+				}
+			}
+		}
+		server.Close()
+	}
+}
+
+func TestConnectionClose(t *testing.T) {
+	var closes []bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		closes = append(closes, r.Close)
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.connClose = true
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	for i := 0; i < 2; i++ {
+		if v, _ := seriesValue(gather(t, reg), "nginx_up"); v != 1 {
+			t.Errorf("scrape %d: got nginx_up %v, want 1", i+1, v)
+		}
+	}
+	if len(closes) != 2 || !closes[0] || !closes[1] {
+		t.Errorf("expected Connection: close on both requests, got %v", closes)
+	}
+}
+
+func TestDisabledCollector(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.enabled.raise = false
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+
+	if _, ok := mfs["nginx_raise"]; ok {
+		t.Error("nginx_raise exported although disabled")
+	}
+	for _, name := range []string{"nginx_up", "nginx_server_up", "nginx_upstream_servers", "nginx_upstream_servers_up"} {
+		if _, ok := mfs[name]; !ok {
+			t.Errorf("%s missing", name)
+		}
+	}
+	if v, _ := seriesValue(mfs, "nginx_server_up", "upstream", "us2", "name", "10.1.0.4:80"); v != 1 {
+		t.Errorf("got nginx_server_up %v, want 1", v)
+	}
+}
+
+func TestConfigInfo(t *testing.T) {
+	*scrapeTimeout, *scrapeRetries, *insecure = 2500*time.Millisecond, 3, false
+	defer func() { *scrapeTimeout, *scrapeRetries, *insecure = 0, 0, true }()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter("http://127.0.0.1:1/status"))
+	mfs := gather(t, reg)
+	if v, ok := seriesValue(mfs, "nginx_exporter_config_info", "timeout_seconds", "2.5", "retries", "3", "insecure", "false"); !ok || v != 1 {
+		t.Errorf("config info missing or wrong: %v", mfs["nginx_exporter_config_info"])
+	}
+}
+
+func TestLowercaseLabels(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0,US1,Backend-A:80,up,10,0,tcp,0\n1,us1,backend-b:80,up,20,0,tcp,0\n"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, lowercase := range []bool{false, true} {
+		e := NewExporter(server.URL)
+		e.lowercase = lowercase
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(e)
+		mfs := gather(t, reg)
+
+		_, lower := seriesValue(mfs, "nginx_raise", "upstream", "us1", "name", "backend-a:80")
+		_, mixed := seriesValue(mfs, "nginx_raise", "upstream", "US1", "name", "Backend-A:80")
+		if lower != lowercase || mixed == lowercase {
+			t.Errorf("lowercase %v: got lowercased series %v, mixed-case series %v", lowercase, lower, mixed)
+		}
+		if lowercase {
+			if v, _ := seriesValue(mfs, "nginx_upstream_servers", "upstream", "us1"); v != 2 {
+				t.Errorf("expected the upstreams to merge into 2 servers, got %v", v)
+			}
+		}
+	}
+}
+
+func TestNameStrip(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0,us1,prod/web-a.example.com:80,up,10,0,tcp,0\n" +
+			"1,us1,prod/web-b.example.com:80,up,20,0,tcp,0\n" +
+			"2,us1,10.1.0.3:80,up,30,0,tcp,0\n" +
+			"3,us1,prod/.example.com:80,up,40,0,tcp,0\n" +
+			"4,us1,web-a.example.com:80,up,50,0,tcp,0\n"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.stripPrefix, e.stripSuffix = "prod/", ".example.com:80"
+	e.errLog.interval = time.Minute
+	logged := capture(e.errLog)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+
+	// prod/web-a.example.com:80 and web-a.example.com:80 both strip to
+	// web-a: their series merge, the last listed prevailing, with a warning.
+	servers := 0
+	for _, m := range mfs["nginx_raise"].GetMetric() {
+		if hasLabels(m, "name", "web-a") {
+			servers++
+		}
+	}
+	if servers != 1 {
+		t.Errorf("got %d web-a series, want them merged into 1", servers)
+	}
+	if len(*logged) != 1 || !strings.Contains((*logged)[0], "both named web-a") {
+		t.Errorf("expected a warning about the web-a collision, got %q", *logged)
+	}
+	gather(t, reg)
+	if len(*logged) != 1 {
+		t.Errorf("expected the repeated warning to be rate limited, got %q", *logged)
+	}
+
+	for name, want := range map[string]float64{
+		"web-a":                     50,
+		"web-b":                     20,
+		"10.1.0.3:80":               30,
+		"prod/.example.com:80":      40,
+		"prod/web-a.example.com:80": 0,
+	} {
+		v, ok := seriesValue(mfs, "nginx_raise", "upstream", "us1", "name", name)
+		if want == 0 {
+			if ok {
+				t.Errorf("unexpected series for unstripped name %s", name)
+			}
+		} else if v != want {
+			t.Errorf("%s: got rise %v, want %v", name, v, want)
+		}
+	}
+}
+
+func TestStableServerIdentity(t *testing.T) {
+	body := nginxStatus
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	gather(t, reg)
+
+	// 10.1.0.2 flaps down and 10.1.0.5 is removed.
+	body = strings.Replace(nginxStatus, "10.1.0.2:80,up,8251,0", "10.1.0.2:80,down,0,2", 1)
+	body = strings.Replace(body, "4,us2,10.1.0.5:80,up,7918,0,tcp,0\n", "", 1)
+	mfs := gather(t, reg)
+
+	for _, name := range []string{"nginx_raise", "nginx_fail", "nginx_server_up"} {
+		for _, m := range mfs[name].GetMetric() {
+			if hasLabels(m, "name", "10.1.0.5:80") {
+				t.Errorf("%s: series of the removed server kept", name)
+			}
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "status" {
+					t.Errorf("%s: series identified by status", name)
+				}
+			}
+		}
+	}
+	if n := len(mfs["nginx_raise"].GetMetric()); n != 4 {
+		t.Errorf("expected 4 raise series, got %d", n)
+	}
+	if v, _ := seriesValue(mfs, "nginx_raise", "name", "10.1.0.2:80"); v != 0 {
+		t.Errorf("got raise %v for the flapped server, want 0", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_fail", "name", "10.1.0.2:80"); v != 2 {
+		t.Errorf("got fail %v for the flapped server, want 2", v)
+	}
+
+	body = nginxStatus
+	mfs = gather(t, reg)
+	if _, ok := seriesValue(mfs, "nginx_fail", "name", "10.1.0.2:80"); ok {
+		t.Error("fail series kept after the server recovered")
+	}
+}
+
+func TestUpstreamMembershipChanges(t *testing.T) {
+	body := nginxStatus
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+	if _, ok := mfs["nginx_upstream_servers_added_total"]; ok {
+		t.Error("servers of the first scrape counted as added")
+	}
+
+	body = strings.Replace(nginxStatus, "0,us1,10.1.0.1:80,up,8247,0,tcp,0\n", "", 1) +
+		"5,us2,10.1.0.6:80,up,1,0,tcp,0\n"
+	mfs = gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_upstream_servers_added_total", "upstream", "us2"); v != 1 {
+		t.Errorf("got %v servers added to us2, want 1", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_upstream_servers_removed_total", "upstream", "us1"); v != 1 {
+		t.Errorf("got %v servers removed from us1, want 1", v)
+	}
+	if _, ok := seriesValue(mfs, "nginx_upstream_servers_added_total", "upstream", "us1"); ok {
+		t.Error("unexpected servers added to us1")
+	}
+}
+
+func TestCheckTypeChanges(t *testing.T) {
+	body := nginxStatus
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	gather(t, reg)
+
+	body = strings.Replace(nginxStatus, "2,us2,10.1.0.3:80,up,8251,0,tcp,0", "2,us2,10.1.0.3:80,up,8251,0,http,0", 1)
+	mfs := gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_servers_check_type_changed_total", "upstream", "us2"); v != 1 {
+		t.Errorf("got %v check type changes in us2, want 1", v)
+	}
+	if _, ok := seriesValue(mfs, "nginx_servers_check_type_changed_total", "upstream", "us1"); ok {
+		t.Error("unexpected check type changes in us1")
+	}
+	if v, _ := seriesValue(mfs, "nginx_upstream_servers_added_total", "upstream", "us2"); v != 0 {
+		t.Error("server changing its check type counted as added")
+	}
+
+	mfs = gather(t, reg)
+	if v, _ := seriesValue(mfs, "nginx_servers_check_type_changed_total", "upstream", "us2"); v != 1 {
+		t.Errorf("got %v check type changes in us2 after an unchanged scrape, want 1", v)
+	}
+}
+
+func TestHighFallRatio(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0,us1,10.1.0.1:80,up,90,10,tcp,0\n" +
+			"1,us1,10.1.0.2:80,up,40,60,tcp,0\n" +
+			"2,us1,10.1.0.3:80,down,0,5,tcp,0\n" +
+			"3,us2,10.1.0.4:80,up,0,0,tcp,0\n" +
+			"4,us2,10.1.0.5:80,up,75,25,tcp,0\n"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.fallRatio = 0.25
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+	for upstream, want := range map[string]float64{"us1": 2, "us2": 0} {
+		if v, ok := seriesValue(mfs, "nginx_servers_high_fall_ratio", "upstream", upstream); !ok || v != want {
+			t.Errorf("%s: got %v servers with a high fall ratio, want %v", upstream, v, want)
+		}
+	}
+
+	e.fallRatio = 0
+	if _, ok := gather(t, reg)["nginx_servers_high_fall_ratio"]; ok {
+		t.Error("nginx_servers_high_fall_ratio exported without a threshold")
+	}
+}
+
+func TestUpstreamAvailability(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatusWithReasons))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+	for upstream, want := range map[string]float64{"us1": 0.5, "us2": 0} {
+		if v, ok := seriesValue(mfs, "nginx_upstream_availability_ratio", "upstream", upstream); !ok || v != want {
+			t.Errorf("%s: got availability %v, want %v", upstream, v, want)
+		}
+	}
+}
+
+func TestLargestUpstream(t *testing.T) {
+	body := nginxStatus
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mf := gather(t, reg)["nginx_largest_upstream_info"]
+	if len(mf.GetMetric()) != 1 || !hasLabels(mf.GetMetric()[0], "upstream", "us2") || mf.GetMetric()[0].GetGauge().GetValue() != 3 {
+		t.Errorf("expected us2 with 3 servers, got %v", mf)
+	}
+
+	// On ties, the first upstream by name wins.
+	body = nginxStatus + "5,us0,10.1.0.6:80,up,1,0,tcp,0\n6,us0,10.1.0.7:80,up,1,0,tcp,0\n7,us0,10.1.0.8:80,up,1,0,tcp,0\n"
+	mf = gather(t, reg)["nginx_largest_upstream_info"]
+	if len(mf.GetMetric()) != 1 || !hasLabels(mf.GetMetric()[0], "upstream", "us0") {
+		t.Errorf("expected us0 on a tie, got %v", mf)
+	}
+}
+
+func TestServersUnknownStatus(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Replace(nginxStatus, "10.1.0.4:80,up", "10.1.0.4:80,UP?", 1)))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+	for upstream, want := range map[string]float64{"us1": 0, "us2": 1} {
+		if v, ok := seriesValue(mfs, "nginx_servers_unknown_status", "upstream", upstream); !ok || v != want {
+			t.Errorf("%s: got %v servers with unknown status, want %v", upstream, v, want)
+		}
+	}
+}
+
+func TestUpstreamServerState(t *testing.T) {
+	body := nginxStatusWithReasons + "4,us2,10.1.0.5:80,draining,0,0,http,0\n5,us2,10.1.0.6:80,UP?,0,0,http,0\n"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+	for upstream, states := range map[string]map[string]float64{
+		"us1": {"up": 1, "down": 1, "draining": 0, "unknown": 0},
+		"us2": {"up": 0, "down": 2, "draining": 1, "unknown": 1},
+	} {
+		for state, want := range states {
+			if v, ok := seriesValue(mfs, "nginx_upstream_server_state", "upstream", upstream, "state", state); !ok || v != want {
+				t.Errorf("%s: got %v servers %s, want %v", upstream, v, state, want)
+			}
+		}
+	}
+}
+
+func TestUpstreamsSingleServer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus + "5,us3,10.1.0.6:80,up,8,0,tcp,0\n6,us4,10.1.0.7:80,down,0,2,tcp,0\n"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	if v, _ := seriesValue(gather(t, reg), "nginx_upstreams_single_server"); v != 2 {
+		t.Errorf("got %v single server upstreams, want 2", v)
+	}
+}
+
+func TestTotalRiseFall(t *testing.T) {
+	for _, tt := range []struct {
+		status     string
+		rise, fall float64
+	}{
+		{nginxStatus, 8247 + 8251 + 8251 + 8247 + 7918, 0},
+		{nginxStatusWithReasons, 8247, 3 + 5 + 1},
+	} {
+		status := tt.status
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(status))
+		}))
+		defer server.Close()
+
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(NewExporter(server.URL))
+		mfs := gather(t, reg)
+		if v, ok := seriesValue(mfs, "nginx_total_rise"); !ok || v != tt.rise {
+			t.Errorf("got total rise %v, want %v", v, tt.rise)
+		}
+		if v, ok := seriesValue(mfs, "nginx_total_fall"); !ok || v != tt.fall {
+			t.Errorf("got total fall %v, want %v", v, tt.fall)
+		}
+	}
+}
+
+func TestServerConnErrors(t *testing.T) {
+	status := nginxStatusConnErrors
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(status))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	check := func(want map[string]float64) {
+		t.Helper()
+		mfs := gather(t, reg)
+		for name, w := range want {
+			if v, ok := seriesValue(mfs, "nginx_server_conn_errors_total", "name", name); !ok || v != w {
+				t.Errorf("%s: got %v conn errors, want %v", name, v, w)
+			}
+		}
+	}
+	check(map[string]float64{"10.1.0.1:80": 0, "10.1.0.2:80": 17, "10.1.0.3:80": 4})
+
+	// The increase is added; a count tengine reset is added whole.
+	status = strings.Replace(strings.Replace(nginxStatusConnErrors, ",17\n", ",20\n", 1), ",4\n", ",1\n", 1)
+	check(map[string]float64{"10.1.0.1:80": 0, "10.1.0.2:80": 20, "10.1.0.3:80": 5})
+
+	status = nginxStatus
+	if _, ok := gather(t, reg)["nginx_server_conn_errors_total"]; ok {
+		t.Error("expected no conn errors for a status without the column")
+	}
+}
+
+func TestScrapeCost(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	// Every line holds a server, so the cost is the length of the body.
+	if v, _ := seriesValue(gather(t, reg), "nginx_exporter_scrape_cost"); v != float64(len(nginxStatus)) {
+		t.Errorf("got scrape cost %v, want %d", v, len(nginxStatus))
+	}
+	if got := scrapeCost(0, 0, 0); got != 0 {
+		t.Errorf("got scrape cost %v for an empty body, want 0", got)
+	}
+}
+
+func TestUpstreamFallMax(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatusWithReasons))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+	for upstream, want := range map[string]float64{"us1": 3, "us2": 5} {
+		if v, ok := seriesValue(mfs, "nginx_upstream_fall_max", "upstream", upstream); !ok || v != want {
+			t.Errorf("%s: got fall max %v, want %v", upstream, v, want)
+		}
+	}
+}
+
+func TestMinSuccessfulScrapes(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.minSuccesses = 2
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	for i, want := range []bool{false, true, true} {
+		mfs := gather(t, reg)
+		if _, ok := mfs["nginx_up"]; !ok {
+			t.Errorf("scrape %d: nginx_up missing", i+1)
+		}
+		for _, name := range []string{"nginx_raise", "nginx_server_up", "nginx_upstream_servers"} {
+			if _, ok := mfs[name]; ok != want {
+				t.Errorf("scrape %d: got %s exported %v, want %v", i+1, name, ok, want)
+			}
+		}
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	length := len(nginxStatus)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(length))
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	for _, step := range []struct {
+		length   int
+		mismatch float64
+	}{
+		{len(nginxStatus), 0},
+		{len(nginxStatus) + 100, 1},
+		{len(nginxStatus), 0},
+	} {
+		length = step.length
+		if v, _ := seriesValue(gather(t, reg), "nginx_exporter_content_length_mismatch"); v != step.mismatch {
+			t.Errorf("Content-Length %d: got mismatch %v, want %v", length, v, step.mismatch)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	var requests int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.cacheTTL = time.Minute
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	gather(t, reg)
+	mfs := gather(t, reg)
+	if requests != 1 {
+		t.Errorf("expected 1 status request, got %d", requests)
+	}
+	if v, _ := seriesValue(mfs, "nginx_exporter_cache_misses_total"); v != 1 {
+		t.Errorf("got %v cache misses, want 1", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_exporter_cache_hits_total"); v != 1 {
+		t.Errorf("got %v cache hits, want 1", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_raise", "upstream", "us2", "name", "10.1.0.5:80"); v != 7918 {
+		t.Errorf("got cached raise %v, want 7918", v)
+	}
+}
+
+func TestNativeHistograms(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatusWithReasons))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	*nativeHistograms = true
+	defer func() { *nativeHistograms = false }()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	gather(t, reg)
+	mfs := gather(t, reg)
+
+	for _, m := range mfs["nginx_server_fall_native"].GetMetric() {
+		h := m.GetHistogram()
+		if hasLabels(m, "upstream", "us2") {
+			if h.GetSampleCount() != 4 || h.GetSampleSum() != 12 {
+				t.Errorf("got %d observations summing to %v, want 4 summing to 12", h.GetSampleCount(), h.GetSampleSum())
+			}
+			if h.Schema == nil || len(h.GetBucket()) != 0 {
+				t.Errorf("expected a native histogram without classic buckets, got %v", h)
+			}
+			return
+		}
+	}
+	t.Errorf("no fall histogram for us2: %v", mfs["nginx_server_fall_native"])
+}
+
+func TestCheckTypesCount(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatusWithReasons))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	if v, _ := seriesValue(gather(t, reg), "nginx_check_types_count"); v != 2 {
+		t.Errorf("got %v check types, want 2", v)
+	}
+}
+
+func TestServerOutages(t *testing.T) {
+	down := strings.Replace(nginxStatus, "10.1.0.3:80,up,8251,0", "10.1.0.3:80,down,0,1", 1)
+	var body string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	var mfs map[string]*dto.MetricFamily
+	for _, body = range []string{down, nginxStatus, down, down, nginxStatus, down} {
+		mfs = gather(t, reg)
+	}
+	// The first scrape has no previous state to transition from.
+	if v, _ := seriesValue(mfs, "nginx_server_outages_total", "upstream", "us2", "name", "10.1.0.3:80"); v != 2 {
+		t.Errorf("got %v outages, want 2", v)
+	}
+	if v, ok := seriesValue(mfs, "nginx_server_outages_total", "upstream", "us2", "name", "10.1.0.4:80"); !ok || v != 0 {
+		t.Errorf("got %v outages of a server always up, want 0", v)
+	}
+}
+
+func TestCheckTypeAvailability(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatusWithReasons + "4,us2,10.1.0.5:80,up,8,0,http,0\n"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+	for typ, want := range map[string]float64{"tcp": 0.5, "http": 1.0 / 3} {
+		if v, ok := seriesValue(mfs, "nginx_check_type_availability_ratio", "type", typ); !ok || v != want {
+			t.Errorf("%s: got availability %v, want %v", typ, v, want)
+		}
+	}
+}
+
+func TestAggregationIntervalStates(t *testing.T) {
+	status := "up"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "0,us1,10.1.0.1:80,%s,1,0,tcp,0\n", status)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	e := NewExporter(server.URL)
+	e.aggInterval = 15 * time.Second
+	e.flapDebounce = 2
+	e.now = func() time.Time { return now }
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	// The debounce counts the intervals a server held its state for from
+	// the first scrape finding it, so that neither early scrapes nor one
+	// late scrape flip it, and not across gaps of more than 10 intervals.
+	// An outage is only counted between scrapes less than 10 intervals
+	// apart.
+	for _, tt := range []struct {
+		at      time.Duration
+		status  string
+		up      float64
+		outages float64
+	}{
+		{0, "up", 1, 0},
+		{15 * time.Second, "down", 1, 1},
+		{20 * time.Second, "up", 1, 1},
+		{25 * time.Second, "down", 1, 2},
+		{30 * time.Second, "down", 1, 2},
+		{35 * time.Second, "down", 1, 2},
+		{60 * time.Second, "down", 0, 2},
+		{75 * time.Second, "up", 0, 2},
+		{105 * time.Second, "up", 1, 2},
+		{300 * time.Second, "down", 1, 2},
+		{315 * time.Second, "down", 1, 2},
+		{345 * time.Second, "down", 0, 2},
+		{360 * time.Second, "up", 0, 2},
+		{900 * time.Second, "up", 0, 2},
+		{915 * time.Second, "up", 0, 2},
+		{930 * time.Second, "up", 1, 2},
+	} {
+		now, status = start.Add(tt.at), tt.status
+		mfs := gather(t, reg)
+		if v, _ := seriesValue(mfs, "nginx_server_up", "name", "10.1.0.1:80"); v != tt.up {
+			t.Errorf("scrape at %s: got server up %v, want %v", tt.at, v, tt.up)
+		}
+		if v, _ := seriesValue(mfs, "nginx_server_outages_total", "name", "10.1.0.1:80"); v != tt.outages {
+			t.Errorf("scrape at %s: got %v outages, want %v", tt.at, v, tt.outages)
+		}
+	}
+}
+
+func TestFlapDebounce(t *testing.T) {
+	down := strings.Replace(nginxStatus, "10.1.0.3:80,up,8251,0", "10.1.0.3:80,down,0,1", 1)
+	var body string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.flapDebounce = 3
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	for i, step := range []struct {
+		body string
+		up   float64
+	}{
+		{nginxStatus, 1},
+		// A brief flap doesn't change the gauge.
+		{down, 1},
+		{nginxStatus, 1},
+		{down, 1},
+		{down, 1},
+		{down, 0},
+		{nginxStatus, 0},
+	} {
+		body = step.body
+		if v, _ := seriesValue(gather(t, reg), "nginx_server_up", "name", "10.1.0.3:80"); v != step.up {
+			t.Errorf("scrape %d: got nginx_server_up %v, want %v", i, v, step.up)
+		}
+	}
+}
+
+func TestUpstreamWeight(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatusWeights))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+
+	for _, tt := range []struct {
+		upstream   string
+		total, max float64
+	}{
+		{"us1", 6, 5},
+		{"us2", 4, 2},
+	} {
+		if v, _ := seriesValue(mfs, "nginx_upstream_weight_total", "upstream", tt.upstream); v != tt.total {
+			t.Errorf("%s: got weight total %v, want %v", tt.upstream, v, tt.total)
+		}
+		if v, _ := seriesValue(mfs, "nginx_upstream_weight_max", "upstream", tt.upstream); v != tt.max {
+			t.Errorf("%s: got weight max %v, want %v", tt.upstream, v, tt.max)
+		}
+	}
+}
+
+func TestObservedScrapeInterval(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	if _, ok := gather(t, reg)["nginx_exporter_observed_scrape_interval_seconds"]; ok {
+		t.Error("interval exported after a single collect")
+	}
+	time.Sleep(50 * time.Millisecond)
+	v, ok := seriesValue(gather(t, reg), "nginx_exporter_observed_scrape_interval_seconds")
+	if !ok || v < 0.05 || v > 1 {
+		t.Errorf("got interval %v, want about 0.05", v)
+	}
+}
+
+func TestTargetTimeDrift(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+
+	// The Date header has a resolution of one second.
+	v, ok := seriesValue(gather(t, reg), "nginx_exporter_target_time_drift_seconds")
+	if !ok || v < 3598 || v > 3601 {
+		t.Errorf("got time drift %v, want about 3600", v)
+	}
+}
+
+func TestSectionLabel(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatusSections))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	*sectionLabel = true
+	defer func() { *sectionLabel = false }()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+
+	for _, tt := range []struct {
+		section, name string
+		rise          float64
+	}{
+		{"0", "10.1.0.1:80", 8247},
+		{"1", "10.2.0.1:80", 120},
+		{"1", "10.2.0.2:80", 118},
+	} {
+		if v, ok := seriesValue(mfs, "nginx_raise", "section", tt.section, "name", tt.name); !ok || v != tt.rise {
+			t.Errorf("section %s %s: got raise %v, want %v", tt.section, tt.name, v, tt.rise)
+		}
+	}
+	if v, ok := seriesValue(mfs, "nginx_server_up", "section", "0", "name", "10.1.0.2:80"); !ok || v != 0 {
+		t.Errorf("section 0 10.1.0.2:80: got server up %v, want 0", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_exporter_scrape_errors_total"); v != 0 {
+		t.Errorf("got %v scrape errors, want 0", v)
+	}
+}
+
+func TestOrderLabel(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	*orderLabel = true
+	defer func() { *orderLabel = false }()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+
+	for i, name := range []string{"10.1.0.1:80", "10.1.0.2:80", "10.1.0.3:80", "10.1.0.4:80", "10.1.0.5:80"} {
+		order := strconv.Itoa(i)
+		if v, ok := seriesValue(mfs, "nginx_server_up", "order", order, "name", name); !ok || v != 1 {
+			t.Errorf("%s: got server up %v with order %s, want 1", name, v, order)
+		}
+	}
+}
+
+func TestTypeInIdentity(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0,us1,10.1.0.1:80,up,8,0,tcp,0\n1,us1,10.1.0.1:80,down,0,3,http,0\n"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.errLog.interval = time.Minute
+	logged := capture(e.errLog)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	mfs := gather(t, reg)
+	if n := len(mfs["nginx_server_up"].GetMetric()); n != 1 {
+		t.Errorf("expected the duplicate to be dropped, got %d servers up", n)
+	}
+	gather(t, reg)
+	if len(*logged) != 1 || !strings.Contains((*logged)[0], "check types tcp and http") {
+		t.Errorf("expected one rate-limited warning about the duplicate, got %q", *logged)
+	}
+	if v, _ := seriesValue(mfs, "nginx_server_up", "upstream", "us1", "name", "10.1.0.1:80"); v != 1 {
+		t.Errorf("expected the first, tcp checked server to be kept, got server up %v", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_upstream_servers", "upstream", "us1"); v != 1 {
+		t.Errorf("got %v servers in us1, want 1", v)
+	}
+
+	*typeIdentity = true
+	defer func() { *typeIdentity = false }()
+	reg = prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs = gather(t, reg)
+	for typ, want := range map[string]float64{"tcp": 1, "http": 0} {
+		if v, ok := seriesValue(mfs, "nginx_server_up", "name", "10.1.0.1:80", "type", typ); !ok || v != want {
+			t.Errorf("%s: got server up %v, want %v", typ, v, want)
+		}
+	}
+	if v, _ := seriesValue(mfs, "nginx_upstream_servers", "upstream", "us1"); v != 2 {
+		t.Errorf("got %v servers in us1, want 2", v)
+	}
+}
+
+func TestDebugRawColumns(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# generated by tengine\n" + nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	if _, ok := gather(t, reg)["nginx_exporter_raw_column"]; ok {
+		t.Error("nginx_exporter_raw_column exported without -metrics.debug-raw-columns")
+	}
+
+	*debugRawColumns = true
+	defer func() { *debugRawColumns = false }()
+	reg = prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+	want := []string{"0", "us1", "10.1.0.1:80", "up", "8247", "0", "tcp", "0"}
+	if n := len(mfs["nginx_exporter_raw_column"].GetMetric()); n != len(want) {
+		t.Errorf("expected %d raw columns, got %d", len(want), n)
+	}
+	for i, value := range want {
+		if v, ok := seriesValue(mfs, "nginx_exporter_raw_column", "col", strconv.Itoa(i), "value", value); !ok || v != 1 {
+			t.Errorf("column %d: expected value %q, got %v", i, value, v)
+		}
+	}
+}
+
+func TestLabelTemplate(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatusWithReasons))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	defer func(l labelsFlag) { labelTemplate = l }(labelTemplate)
+	if err := labelTemplate.Set("upstream,name,type"); err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+
+	for _, metric := range mfs["nginx_server_up"].GetMetric() {
+		var names []string
+		for _, l := range metric.GetLabel() {
+			names = append(names, l.GetName())
+		}
+		if got := strings.Join(names, ","); got != "name,type,upstream" {
+			t.Errorf("got labels %s, want name,type,upstream", got)
+		}
+	}
+	if v, ok := seriesValue(mfs, "nginx_server_up", "upstream", "us2", "name", "10.1.0.3:80", "type", "http"); !ok || v != 0 {
+		t.Errorf("got server up %v for the http checked server, want 0", v)
+	}
+	if _, ok := seriesValue(mfs, "nginx_server_down_reason_info", "type", "http", "reason", "bad status code"); !ok {
+		t.Error("down reason lacks the template labels")
+	}
+}
+
+func TestServerDownReason(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatusWithReasons))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL))
+	mfs := gather(t, reg)
+
+	if n := len(mfs["nginx_server_down_reason_info"].GetMetric()); n != 2 {
+		t.Fatalf("expected 2 down reasons, got %d", n)
+	}
+	for _, tt := range []struct{ upstream, name, reason string }{
+		{"us1", "10.1.0.2:80", "connect timeout"},
+		{"us2", "10.1.0.3:80", "bad status code"},
+	} {
+		if v, ok := seriesValue(mfs, "nginx_server_down_reason_info", "upstream", tt.upstream, "name", tt.name, "reason", tt.reason); !ok || v != 1 {
+			t.Errorf("missing down reason %q for %s/%s", tt.reason, tt.upstream, tt.name)
+		}
+	}
+}
+
+func TestScrapeSuccessRatio(t *testing.T) {
+	// Fail the second and fifth request.
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 2 || requests == 5 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.window = newScrapeWindow(4)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	for i, want := range []float64{1, 0.5, 2.0 / 3, 0.75, 0.5} {
+		mfs := gather(t, reg)
+		if got, _ := seriesValue(mfs, "nginx_exporter_scrape_success_ratio"); got != want {
+			t.Errorf("scrape %d: got success ratio %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+// gather collects g once and returns the gathered metric families by name.
+func gather(t *testing.T, g prometheus.Gatherer) map[string]*dto.MetricFamily {
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		byName[mf.GetName()] = mf
+	}
+	return byName
+}
+
+// seriesValue returns the value of the first series of family name that has
+// all of the given label name/value pairs.
+func seriesValue(mfs map[string]*dto.MetricFamily, name string, labels ...string) (float64, bool) {
+	for _, m := range mfs[name].GetMetric() {
+		if !hasLabels(m, labels...) {
+			continue
+		}
+		switch {
+		case m.Gauge != nil:
+			return m.GetGauge().GetValue(), true
+		case m.Counter != nil:
+			return m.GetCounter().GetValue(), true
+		default:
+			return m.GetUntyped().GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+func hasLabels(m *dto.Metric, labels ...string) bool {
+	for i := 0; i+1 < len(labels); i += 2 {
+		found := false
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() == labels[i] && lp.GetValue() == labels[i+1] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
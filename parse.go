@@ -0,0 +1,560 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ServerStatus is a single server line of the tengine upstream check status,
+// e.g. "0,us1,10.1.0.1:80,up,8247,0,tcp,0". Newer tengine versions may append
+// the reason a server is down as a ninth column.
+type ServerStatus struct {
+	Upstream string
+	Name     string
+	Status   string
+	Rise     int
+	Fall     int
+	Type     string
+	Reason   string
+	Section  int
+	Weight   int // 0 if the status has no weight column.
+	Index    int // -1 if the status has no index column.
+	// ConnErrors is the number of connection errors tengine accumulated for
+	// the server, -1 if the status has no conn_errors column.
+	ConnErrors int
+}
+
+// serverKey identifies a server across scrapes.
+type serverKey struct {
+	upstream, name string
+	typ            string // Only set with -metrics.type-in-identity.
+}
+
+func (s ServerStatus) key() serverKey {
+	return serverKey{upstream: s.Upstream, name: s.Name}
+}
+
+// parseError describes a status line that could not be parsed. Field is
+// used as the collector label of the scrape error counter.
+type parseError struct {
+	Line  int
+	Field string
+	Err   error
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("line %d: error parsing %s: %s", e.Line, e.Field, e.Err)
+}
+
+// columnMap holds the column of each ServerStatus field, -1 if absent.
+type columnMap struct {
+	upstream, name, status, rise, fall, typ, reason, weight, index, connErrors int
+}
+
+// defaultColumns is the column layout of the tengine csv format.
+var defaultColumns = columnMap{upstream: 1, name: 2, status: 3, rise: 4, fall: 5, typ: 6, reason: 8, weight: -1, index: 0, connErrors: -1}
+
+// minColumns returns the number of columns a line needs to hold all of the
+// required fields.
+func (m columnMap) minColumns() int {
+	n := 0
+	for _, c := range []int{m.upstream, m.name, m.status, m.rise, m.fall} {
+		if c+1 > n {
+			n = c + 1
+		}
+	}
+	return n
+}
+
+// atoi parses a numeric field, an empty one as 0 with
+// -nginx.empty-field-as-zero.
+func atoi(s string) (int, error) {
+	if *emptyFieldZero && strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// isComment reports whether line starts with -nginx.comment-prefix.
+func isComment(line string) bool {
+	return *commentPrefix != "" && strings.HasPrefix(line, *commentPrefix)
+}
+
+// isHeader reports whether line names columns rather than holding a server.
+func isHeader(line string) bool {
+	var upstream, name bool
+	for _, col := range strings.Split(line, ",") {
+		switch strings.ToLower(strings.TrimSpace(col)) {
+		case "upstream":
+			upstream = true
+		case "name":
+			name = true
+		}
+	}
+	return upstream && name
+}
+
+// parseHeader returns the column map named by a header line, which isHeader
+// guarantees to have upstream and name columns.
+func parseHeader(line string) (columnMap, error) {
+	m := columnMap{-1, -1, -1, -1, -1, -1, -1, -1, -1, -1}
+	for i, col := range strings.Split(line, ",") {
+		switch strings.ToLower(strings.TrimSpace(col)) {
+		case "upstream":
+			m.upstream = i
+		case "name":
+			m.name = i
+		case "status":
+			m.status = i
+		case "rise":
+			m.rise = i
+		case "fall":
+			m.fall = i
+		case "type":
+			m.typ = i
+		case "reason":
+			m.reason = i
+		case "weight":
+			m.weight = i
+		case "index":
+			m.index = i
+		case "conn_errors":
+			m.connErrors = i
+		}
+	}
+	for _, c := range []struct {
+		name string
+		col  int
+	}{{"status", m.status}, {"rise", m.rise}, {"fall", m.fall}} {
+		if c.col < 0 {
+			return m, fmt.Errorf("header lacks a %s column", c.name)
+		}
+	}
+	return m, nil
+}
+
+// layout describes the sections of a status body. Sections are separated by
+// empty lines and may start with a header line naming their columns, e.g.
+// "index,upstream,name,status,rise,fall,type,port". Sections without a
+// header use the default tengine columns. Lines holding only whitespace and
+// comment lines, starting with -nginx.comment-prefix, are skipped without
+// ending their section.
+type layout struct {
+	section []int       // section of each line, -1 for lines holding no server
+	columns []columnMap // columns of each section
+}
+
+func scanLayout(lines []string) (*layout, []*parseError) {
+	var (
+		l    = &layout{section: make([]int, len(lines))}
+		errs []*parseError
+		// sec is the current section, starting at the first line.
+		sec   = -1
+		empty = true
+		valid = true
+	)
+	for i, line := range lines {
+		l.section[i] = -1
+		if len(line) <= 0 {
+			empty = true
+			continue
+		}
+		if strings.TrimSpace(line) == "" || isComment(line) {
+			continue
+		}
+		if empty {
+			sec++
+			empty = false
+			valid = true
+			l.columns = append(l.columns, defaultColumns)
+			if isHeader(line) {
+				m, err := parseHeader(line)
+				if err != nil {
+					errs = append(errs, &parseError{i + 1, "header", err})
+					valid = false
+				}
+				l.columns[sec] = m
+				continue
+			}
+		}
+		if valid {
+			l.section[i] = sec
+		}
+	}
+	return l, errs
+}
+
+// parseStatus parses a tengine status body in csv format. Lines that cannot
+// be parsed are reported as errors and left out of the returned servers.
+func parseStatus(data []byte) ([]ServerStatus, []*parseError) {
+	return parseStatusParallel(data, 1)
+}
+
+// parseStatusParallel splits the body into one chunk of lines per worker and
+// parses the chunks concurrently. The result is the same as parseStatus.
+func parseStatusParallel(data []byte, workers int) ([]ServerStatus, []*parseError) {
+	lines := strings.Split(string(data), "\n")
+	l, errs := scanLayout(lines)
+	if workers <= 1 || len(lines) < workers {
+		servers, lineErrs := parseLines(lines, 0, l)
+		return servers, append(errs, lineErrs...)
+	}
+
+	type result struct {
+		servers []ServerStatus
+		errs    []*parseError
+		panic   interface{}
+	}
+	size := (len(lines) + workers - 1) / workers
+	results := make([]result, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		start := i * size
+		if start >= len(lines) {
+			break
+		}
+		end := start + size
+		if end > len(lines) {
+			end = len(lines)
+		}
+		wg.Add(1)
+		atomic.AddInt64(&scrapeGoroutines, 1)
+		go func(i, start, end int) {
+			defer wg.Done()
+			defer atomic.AddInt64(&scrapeGoroutines, -1)
+			// A panic would crash the process from here; it is raised
+			// again in the calling goroutine, which may recover.
+			defer func() { results[i].panic = recover() }()
+			results[i].servers, results[i].errs = parseLines(lines[start:end], start, l)
+		}(i, start, end)
+	}
+	wg.Wait()
+
+	for _, r := range results {
+		if r.panic != nil {
+			panic(r.panic)
+		}
+	}
+	var servers []ServerStatus
+	for _, r := range results {
+		servers = append(servers, r.servers...)
+		errs = append(errs, r.errs...)
+	}
+	return servers, errs
+}
+
+// parseLines parses lines, offset being the number of lines preceding them
+// in the body described by l.
+func parseLines(lines []string, offset int, l *layout) ([]ServerStatus, []*parseError) {
+	var (
+		servers []ServerStatus
+		errs    []*parseError
+	)
+	for i, line := range lines {
+		sec := l.section[offset+i]
+		if sec < 0 {
+			continue
+		}
+		lineno := offset + i + 1
+		m := l.columns[sec]
+		var (
+			s        ServerStatus
+			ok       bool
+			lineErrs []*parseError
+		)
+		if cols, std := splitStandard(line); std && m == defaultColumns {
+			s, ok, lineErrs = parseStandardLine(&cols, lineno, sec)
+		} else {
+			s, ok, lineErrs = parseColumns(strings.Split(line, ","), m, lineno, sec)
+		}
+		errs = append(errs, lineErrs...)
+		if ok {
+			servers = append(servers, s)
+		}
+	}
+	return servers, errs
+}
+
+// standardColumns is the number of columns of the tengine csv format, e.g.
+// "0,us1,10.1.0.1:80,up,8247,0,tcp,0".
+const standardColumns = 8
+
+// splitStandard splits line into its columns without allocating, reporting
+// whether it has exactly as many as the tengine csv format.
+func splitStandard(line string) (cols [standardColumns]string, ok bool) {
+	for i := 0; i < standardColumns-1; i++ {
+		j := strings.IndexByte(line, ',')
+		if j < 0 {
+			return cols, false
+		}
+		cols[i], line = line[:j], line[j+1:]
+	}
+	if strings.IndexByte(line, ',') >= 0 {
+		return cols, false
+	}
+	cols[standardColumns-1] = line
+	return cols, true
+}
+
+// parseStandardLine is parseLine for the columns of the tengine csv format,
+// indexing them directly. Most status bodies are in this format, so it is
+// kept apart from the column map lookups of parseLine; both must return the
+// same for the same line.
+func parseStandardLine(cols *[standardColumns]string, lineno, sec int) (ServerStatus, bool, []*parseError) {
+	var errs []*parseError
+	s := ServerStatus{
+		Upstream:   cols[1],
+		Name:       cols[2],
+		Status:     cols[3],
+		Type:       cols[6],
+		Section:    sec,
+		Index:      -1,
+		ConnErrors: -1,
+	}
+	ok := true
+	var err error
+	if s.Rise, err = atoi(cols[4]); err != nil {
+		errs = append(errs, &parseError{lineno, "raise", err})
+		ok = false
+	}
+	if s.Fall, err = atoi(cols[5]); err != nil {
+		errs = append(errs, &parseError{lineno, "fail", err})
+		ok = false
+	}
+	if s.Index, err = atoi(strings.TrimSpace(cols[0])); err != nil {
+		errs = append(errs, &parseError{lineno, "index", err})
+		s.Index = -1
+	}
+	return s, ok, errs
+}
+
+// parseColumns parses the lines that aren't in the tengine csv format. Tests
+// replace it to feed the scrapes a parser that panics.
+var parseColumns = parseLine
+
+// parseLine parses the columns of a line laid out as m, reporting whether
+// the server is kept.
+func parseLine(cols []string, m columnMap, lineno, sec int) (ServerStatus, bool, []*parseError) {
+	var errs []*parseError
+	if n := m.minColumns(); len(cols) < n {
+		errs = append(errs, &parseError{lineno, "line", fmt.Errorf("expected at least %d columns, got %d", n, len(cols))})
+		return ServerStatus{}, false, errs
+	}
+	s := ServerStatus{
+		Upstream:   cols[m.upstream],
+		Name:       cols[m.name],
+		Status:     cols[m.status],
+		Section:    sec,
+		Index:      -1,
+		ConnErrors: -1,
+	}
+	if m.typ >= 0 && len(cols) > m.typ {
+		s.Type = cols[m.typ]
+	}
+	if m.reason >= 0 && len(cols) > m.reason {
+		s.Reason = strings.TrimSpace(cols[m.reason])
+	}
+
+	ok := true
+	var err error
+	if s.Rise, err = atoi(cols[m.rise]); err != nil {
+		errs = append(errs, &parseError{lineno, "raise", err})
+		ok = false
+	}
+	if s.Fall, err = atoi(cols[m.fall]); err != nil {
+		errs = append(errs, &parseError{lineno, "fail", err})
+		ok = false
+	}
+	// The weight, index and conn errors are informational; a server
+	// with an invalid one is kept, without it.
+	if m.weight >= 0 && len(cols) > m.weight {
+		if s.Weight, err = atoi(strings.TrimSpace(cols[m.weight])); err != nil {
+			errs = append(errs, &parseError{lineno, "weight", err})
+			s.Weight = 0
+		}
+	}
+	if m.index >= 0 && len(cols) > m.index {
+		if s.Index, err = atoi(strings.TrimSpace(cols[m.index])); err != nil {
+			errs = append(errs, &parseError{lineno, "index", err})
+			s.Index = -1
+		}
+	}
+	if m.connErrors >= 0 && len(cols) > m.connErrors {
+		if s.ConnErrors, err = atoi(strings.TrimSpace(cols[m.connErrors])); err != nil {
+			errs = append(errs, &parseError{lineno, "conn_errors", err})
+			s.ConnErrors = -1
+		}
+	}
+	return s, ok, errs
+}
+
+// parsers holds the status parsers by -nginx.format.
+var parsers = map[string]func(data []byte, workers int) ([]ServerStatus, []*parseError){
+	"csv":  parseStatusParallel,
+	"kv":   parseStatusKV,
+	"json": parseStatusJSON,
+}
+
+// validFormat reports whether format is a status page format: one of
+// parsers, or the pages of the reqstat and stub_status modules.
+func validFormat(format string) bool {
+	_, ok := parsers[format]
+	return ok || format == reqstatFormat || format == stubStatusFormat
+}
+
+// parseStatusKV parses a status body made of key=value pairs separated by
+// spaces, one server per line and in any order, e.g.
+// "upstream=us1 server=10.1.0.1:80 status=up rise=8 fall=0". Unknown keys
+// are ignored. The lines are few enough to be parsed by a single worker.
+func parseStatusKV(data []byte, workers int) ([]ServerStatus, []*parseError) {
+	var (
+		servers []ServerStatus
+		errs    []*parseError
+	)
+	for i, line := range strings.Split(string(data), "\n") {
+		lineno := i + 1
+		fields := strings.Fields(line)
+		if len(fields) == 0 || isComment(line) {
+			continue
+		}
+		kv := make(map[string]string, len(fields))
+		for _, f := range fields {
+			if parts := strings.SplitN(f, "=", 2); len(parts) == 2 {
+				kv[strings.ToLower(parts[0])] = parts[1]
+			}
+		}
+		if _, ok := kv["server"]; !ok {
+			kv["server"] = kv["name"]
+		}
+		var missing []string
+		for _, k := range []string{"upstream", "server", "status", "rise", "fall"} {
+			v, found := kv[k]
+			if v == "" && !(found && *emptyFieldZero && (k == "rise" || k == "fall")) {
+				missing = append(missing, k)
+			}
+		}
+		if len(missing) > 0 {
+			errs = append(errs, &parseError{lineno, "line", fmt.Errorf("missing %s", strings.Join(missing, ", "))})
+			continue
+		}
+		s := ServerStatus{
+			Upstream:   kv["upstream"],
+			Name:       kv["server"],
+			Status:     kv["status"],
+			Type:       kv["type"],
+			Reason:     kv["reason"],
+			Index:      -1,
+			ConnErrors: -1,
+		}
+
+		ok := true
+		var err error
+		if s.Rise, err = atoi(kv["rise"]); err != nil {
+			errs = append(errs, &parseError{lineno, "raise", err})
+			ok = false
+		}
+		if s.Fall, err = atoi(kv["fall"]); err != nil {
+			errs = append(errs, &parseError{lineno, "fail", err})
+			ok = false
+		}
+		if w, found := kv["weight"]; found {
+			if s.Weight, err = atoi(w); err != nil {
+				errs = append(errs, &parseError{lineno, "weight", err})
+				s.Weight = 0
+			}
+		}
+		if i, found := kv["index"]; found {
+			if s.Index, err = atoi(i); err != nil {
+				errs = append(errs, &parseError{lineno, "index", err})
+				s.Index = -1
+			}
+		}
+		if c, found := kv["conn_errors"]; found {
+			if s.ConnErrors, err = atoi(c); err != nil {
+				errs = append(errs, &parseError{lineno, "conn_errors", err})
+				s.ConnErrors = -1
+			}
+		}
+		if ok {
+			servers = append(servers, s)
+		}
+	}
+	return servers, errs
+}
+
+// jsonStatus is the status body of tengine's check_status?format=json.
+type jsonStatus struct {
+	Servers struct {
+		Server []struct {
+			Index      *int   `json:"index"`
+			Upstream   string `json:"upstream"`
+			Name       string `json:"name"`
+			Status     string `json:"status"`
+			Rise       *int   `json:"rise"`
+			Fall       *int   `json:"fall"`
+			Type       string `json:"type"`
+			Reason     string `json:"reason"`
+			Weight     int    `json:"weight"`
+			ConnErrors *int   `json:"conn_errors"`
+		} `json:"server"`
+	} `json:"servers"`
+}
+
+// parseStatusJSON parses a status body in tengine's json format. The line of
+// an error is the position of the server in the list, or 0 if the body is
+// not valid json. A body is decoded as a whole, by a single worker.
+func parseStatusJSON(data []byte, workers int) ([]ServerStatus, []*parseError) {
+	var status jsonStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, []*parseError{{0, "json", err}}
+	}
+	var (
+		servers []ServerStatus
+		errs    []*parseError
+	)
+	for i, srv := range status.Servers.Server {
+		var missing []string
+		for _, f := range []struct {
+			name    string
+			present bool
+		}{
+			{"upstream", srv.Upstream != ""},
+			{"name", srv.Name != ""},
+			{"status", srv.Status != ""},
+			{"rise", srv.Rise != nil},
+			{"fall", srv.Fall != nil},
+		} {
+			if !f.present {
+				missing = append(missing, f.name)
+			}
+		}
+		if len(missing) > 0 {
+			errs = append(errs, &parseError{i + 1, "line", fmt.Errorf("missing %s", strings.Join(missing, ", "))})
+			continue
+		}
+		index, connErrors := -1, -1
+		if srv.Index != nil {
+			index = *srv.Index
+		}
+		if srv.ConnErrors != nil {
+			connErrors = *srv.ConnErrors
+		}
+		servers = append(servers, ServerStatus{
+			Upstream:   srv.Upstream,
+			Name:       srv.Name,
+			Status:     srv.Status,
+			Rise:       *srv.Rise,
+			Fall:       *srv.Fall,
+			Type:       srv.Type,
+			Reason:     srv.Reason,
+			Weight:     srv.Weight,
+			Index:      index,
+			ConnErrors: connErrors,
+		})
+	}
+	return servers, errs
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStatus(t *testing.T) {
+	servers, errs := parseStatus([]byte(nginxStatus + "5,us3,10.1.0.6:80,up,x,0,tcp,0\n6,us3\n"))
+	if len(servers) != 5 {
+		t.Fatalf("expected 5 servers, got %d", len(servers))
+	}
+	want := ServerStatus{Upstream: "us1", Name: "10.1.0.1:80", Status: "up", Rise: 8247, Fall: 0, Type: "tcp", ConnErrors: -1}
+	if servers[0] != want {
+		t.Errorf("got %+v, want %+v", servers[0], want)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+	if errs[0].Line != 6 || errs[0].Field != "raise" {
+		t.Errorf("unexpected error %v", errs[0])
+	}
+	if errs[1].Line != 7 || errs[1].Field != "line" {
+		t.Errorf("unexpected error %v", errs[1])
+	}
+}
+
+func TestParseStatusReason(t *testing.T) {
+	servers, errs := parseStatus([]byte(nginxStatusWithReasons))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	for i, want := range []string{"", "connect timeout", "bad status code", ""} {
+		if servers[i].Reason != want {
+			t.Errorf("server %d: got reason %q, want %q", i, servers[i].Reason, want)
+		}
+	}
+}
+
+func TestParseStatusWeight(t *testing.T) {
+	servers, errs := parseStatus([]byte(nginxStatusWeights + "us3,10.1.0.6:80,up,1,0,x\n"))
+	if len(errs) != 1 || errs[0].Field != "weight" || errs[0].Line != 6 {
+		t.Errorf("expected a weight error on line 6, got %v", errs)
+	}
+	if len(servers) != 5 {
+		t.Fatalf("expected 5 servers, got %d", len(servers))
+	}
+	for i, want := range []int{5, 1, 2, 2, 0} {
+		if servers[i].Weight != want {
+			t.Errorf("server %d: got weight %d, want %d", i, servers[i].Weight, want)
+		}
+	}
+}
+
+func TestParseStatusWhitespaceLines(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(nginxStatusWeights, "\n"), "\n")
+	data := strings.Join(lines[:2], "\n") + "\n   \n" + strings.Join(lines[2:], "\n\t\n") + "\n \n"
+	servers, errs := parseStatus([]byte(data))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	want, _ := parseStatus([]byte(nginxStatusWeights))
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("got %+v, want %+v", servers, want)
+	}
+}
+
+func TestParseStatusComments(t *testing.T) {
+	lines := strings.SplitAfter(nginxStatusSections, "\n")
+	data := "# tengine upstream check status\n" + strings.Join(lines[:2], "") + "# us3 follows\n" + strings.Join(lines[2:], "")
+	servers, errs := parseStatus([]byte(data))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	want, _ := parseStatus([]byte(nginxStatusSections))
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("got %+v, want %+v", servers, want)
+	}
+
+	*commentPrefix = ""
+	defer func() { *commentPrefix = "#" }()
+	if _, errs := parseStatus([]byte(data)); len(errs) != 2 {
+		t.Errorf("expected 2 errors without a comment prefix, got %v", errs)
+	}
+}
+
+func TestParseStatusKV(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/status.kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, errs := parseStatusKV(data, 1)
+	want := []ServerStatus{
+		{Upstream: "us1", Name: "10.1.0.1:80", Status: "up", Rise: 8, Type: "tcp", Index: -1, ConnErrors: -1},
+		{Upstream: "us1", Name: "10.1.0.2:80", Status: "down", Fall: 3, Type: "http", Index: -1, ConnErrors: -1},
+		{Upstream: "us2", Name: "10.1.0.3:80", Status: "up", Rise: 12, Weight: 2, Index: -1, ConnErrors: -1},
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("got %+v, want %+v", servers, want)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+	if errs[0].Line != 5 || errs[0].Field != "raise" {
+		t.Errorf("unexpected error %v", errs[0])
+	}
+	if errs[1].Line != 6 || errs[1].Field != "line" || !strings.Contains(errs[1].Error(), "missing server") {
+		t.Errorf("unexpected error %v", errs[1])
+	}
+}
+
+func TestParseStatusJSON(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/status.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, errs := parseStatusJSON(data, 1)
+	want := []ServerStatus{
+		{Upstream: "us1", Name: "10.1.0.1:80", Status: "up", Rise: 8, Type: "tcp", ConnErrors: -1},
+		{Upstream: "us1", Name: "10.1.0.2:80", Status: "down", Fall: 3, Type: "http", Index: 1, ConnErrors: -1},
+		{Upstream: "us2", Name: "10.1.0.3:80", Status: "up", Rise: 12, Type: "tcp", Index: 2, ConnErrors: -1},
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("got %+v, want %+v", servers, want)
+	}
+	if len(errs) != 1 || errs[0].Line != 4 || !strings.Contains(errs[0].Error(), "missing rise") {
+		t.Errorf("expected a missing rise error for server 4, got %v", errs)
+	}
+
+	if _, errs := parseStatusJSON([]byte(nginxStatus), 1); len(errs) != 1 || errs[0].Field != "json" {
+		t.Errorf("expected a json error for a csv body, got %v", errs)
+	}
+}
+
+func TestParseStatusSections(t *testing.T) {
+	servers, errs := parseStatus([]byte(nginxStatusSections))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	want := []ServerStatus{
+		{Upstream: "us1", Name: "10.1.0.1:80", Status: "up", Rise: 8247, Type: "tcp", ConnErrors: -1},
+		{Upstream: "us1", Name: "10.1.0.2:80", Status: "down", Fall: 3, Type: "tcp", Index: 1, ConnErrors: -1},
+		{Upstream: "us3", Name: "10.2.0.1:80", Status: "up", Rise: 120, Section: 1, Index: -1, ConnErrors: -1},
+		{Upstream: "us3", Name: "10.2.0.2:80", Status: "up", Rise: 118, Section: 1, Index: -1, ConnErrors: -1},
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("got %+v, want %+v", servers, want)
+	}
+
+	_, errs = parseStatus([]byte("upstream,name,rise\nus1,a,1\n\n0,us2,b,up,1,0,tcp,0\n"))
+	if len(errs) != 1 || errs[0].Field != "header" || errs[0].Line != 1 {
+		t.Errorf("expected a header error on line 1, got %v", errs)
+	}
+}
+
+func TestParseStatusConnErrors(t *testing.T) {
+	servers, errs := parseStatus([]byte(nginxStatusConnErrors + "3,us2,10.1.0.4:80,up,8251,0,tcp,0,x\n"))
+	if len(errs) != 1 || errs[0].Field != "conn_errors" || errs[0].Line != 5 {
+		t.Errorf("expected a conn_errors error on line 5, got %v", errs)
+	}
+	if len(servers) != 4 {
+		t.Fatalf("expected the server with invalid conn errors to be kept, got %d servers", len(servers))
+	}
+	for i, want := range []int{0, 17, 4, -1} {
+		if servers[i].ConnErrors != want {
+			t.Errorf("server %d: got %d conn errors, want %d", i, servers[i].ConnErrors, want)
+		}
+	}
+}
+
+func TestParseStatusEmptyFields(t *testing.T) {
+	csv := []byte("0,us1,10.1.0.1:80,up,,0,tcp,0\n1,us1,10.1.0.2:80,down,0, ,tcp,0\n")
+	kv := []byte("upstream=us1 server=10.1.0.1:80 status=up rise= fall=2\n")
+	if servers, errs := parseStatus(csv); len(servers) != 0 || len(errs) != 2 || errs[0].Field != "raise" || errs[1].Field != "fail" {
+		t.Errorf("expected raise and fail errors for blank fields, got %v and %v", servers, errs)
+	}
+	if servers, errs := parseStatusKV(kv, 1); len(servers) != 0 || len(errs) != 1 || !strings.Contains(errs[0].Error(), "missing rise") {
+		t.Errorf("expected a missing rise error for a blank rise, got %v and %v", servers, errs)
+	}
+
+	*emptyFieldZero = true
+	defer func() { *emptyFieldZero = false }()
+	servers, errs := parseStatus(csv)
+	if len(errs) != 0 || len(servers) != 2 {
+		t.Fatalf("expected 2 servers without errors, got %v and %v", servers, errs)
+	}
+	if servers[0].Rise != 0 || servers[1].Fall != 0 {
+		t.Errorf("expected blank fields to be 0, got %+v", servers)
+	}
+	servers, errs = parseStatusKV(kv, 1)
+	if len(errs) != 0 || len(servers) != 1 || servers[0].Rise != 0 || servers[0].Fall != 2 {
+		t.Errorf("expected a blank rise to be 0, got %v and %v", servers, errs)
+	}
+}
+
+func TestParseStatusParallel(t *testing.T) {
+	body := bigStatus(1000)
+	body = append(body, "1000,us9,bad,up,x,y,tcp,0\n\n"...)
+	body = append(body, nginxStatusSections...)
+
+	servers, errs := parseStatus(body)
+	for _, workers := range []int{1, 2, 3, 8} {
+		s, e := parseStatusParallel(body, workers)
+		if !reflect.DeepEqual(s, servers) {
+			t.Errorf("%d workers: servers differ from single-threaded parse", workers)
+		}
+		if !reflect.DeepEqual(e, errs) {
+			t.Errorf("%d workers: got errors %v, want %v", workers, e, errs)
+		}
+	}
+}
+
+func BenchmarkParseStatus(b *testing.B) {
+	body := bigStatus(50000)
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				parseStatusParallel(body, workers)
+			}
+		})
+	}
+}
+
+func TestParseStandardLine(t *testing.T) {
+	lines := strings.Split(nginxStatus+nginxStatusWithReasons, "\n")
+	lines = append(lines,
+		"5,us3,10.1.0.6:80,up,x,0,tcp,0",
+		"6,us3,10.1.0.7:80,down,1,y,tcp,0",
+		" 7 ,us3,10.1.0.8:80,up,3,0,http,0",
+		"z,us3,10.1.0.9:80,up,3,0,http,0",
+		",us3,10.1.0.10:80,up,,,http,0",
+	)
+	for _, zero := range []bool{false, true} {
+		*emptyFieldZero = zero
+		for i, line := range lines {
+			cols, ok := splitStandard(line)
+			if !ok {
+				if n := len(strings.Split(line, ",")); n == standardColumns {
+					t.Errorf("%q: not split although it has %d columns", line, n)
+				}
+				continue
+			}
+			s, keep, errs := parseStandardLine(&cols, i+1, 0)
+			want, wantKeep, wantErrs := parseLine(strings.Split(line, ","), defaultColumns, i+1, 0)
+			if !reflect.DeepEqual(s, want) || keep != wantKeep || !reflect.DeepEqual(errs, wantErrs) {
+				t.Errorf("empty as zero %t, %q: got %+v, %t, %v, want %+v, %t, %v", zero, line, s, keep, errs, want, wantKeep, wantErrs)
+			}
+		}
+	}
+	*emptyFieldZero = false
+}
+
+func BenchmarkParseLine(b *testing.B) {
+	lines := strings.Split(strings.TrimSuffix(string(bigStatus(1000)), "\n"), "\n")
+	b.Run("standard", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			line := lines[i%len(lines)]
+			cols, _ := splitStandard(line)
+			parseStandardLine(&cols, i, 0)
+		}
+	})
+	b.Run("generic", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			parseLine(strings.Split(lines[i%len(lines)], ","), defaultColumns, i, 0)
+		}
+	})
+}
+
+// bigStatus returns a status body with n servers spread over 100 upstreams.
+func bigStatus(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "%d,us%d,10.%d.%d.%d:80,up,%d,0,tcp,0\n", i, i%100, i>>16&255, i>>8&255, i&255, i)
+	}
+	return buf.Bytes()
+}
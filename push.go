@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/log"
+)
+
+// pusher pushes the gathered metrics once, e.g. to a Pushgateway.
+type pusher interface {
+	Push() error
+}
+
+// newPusher returns a pusher of the metrics gathered from g to the
+// Pushgateway at url, grouped by job. The job label is applied by the
+// grouping key; the metrics themselves must not carry one. With jobLabel,
+// for -push.job-label, the metrics also carry the job under that label,
+// which outlives the grouping when they are federated or relabelled.
+func newPusher(url, job, jobLabel string, g prometheus.Gatherer) pusher {
+	if jobLabel != "" {
+		g = withLabel(g, jobLabel, job)
+	}
+	return push.New(url, job).Gatherer(g)
+}
+
+// withLabel returns a gatherer of the metrics of g with the label name set
+// to value. Metrics already carrying the label are an error.
+func withLabel(g prometheus.Gatherer, name, value string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		if err != nil {
+			return nil, err
+		}
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == name {
+						return nil, fmt.Errorf("metric %s already has a %s label", mf.GetName(), name)
+					}
+				}
+				m.Label = append(append([]*dto.LabelPair(nil), m.Label...), &dto.LabelPair{Name: &name, Value: &value})
+				sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+			}
+		}
+		return mfs, nil
+	})
+}
+
+// pushOffset returns a random offset in [0, jitter) that every push of the
+// process is delayed by, so that exporters started together do not push at
+// the same time. It is drawn once per process rather than once per push.
+func pushOffset(jitter time.Duration, rnd *rand.Rand) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rnd.Int63n(int64(jitter)))
+}
+
+// pushLoop pushes each interval, offset after start, for -push.gateway. It
+// stops after cycles pushes, or never if cycles is zero or less.
+func pushLoop(p pusher, start time.Time, interval, offset time.Duration, cycles int) {
+	next := start.Add(offset)
+	for i := 0; cycles <= 0 || i < cycles; i++ {
+		time.Sleep(time.Until(next))
+		if err := p.Push(); err != nil {
+			log.Errorf("Error pushing metrics: %s", err)
+		}
+		next = next.Add(interval)
+		// Skip the pushes a slow push made us miss rather than catching up.
+		for now := time.Now(); next.Before(now); {
+			next = next.Add(interval)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type recordingPusher struct {
+	times []time.Time
+}
+
+func (p *recordingPusher) Push() error {
+	p.times = append(p.times, time.Now())
+	return nil
+}
+
+func TestPushOffset(t *testing.T) {
+	const jitter = 100 * time.Millisecond
+	if got := pushOffset(0, rand.New(rand.NewSource(1))); got != 0 {
+		t.Errorf("expected no offset without jitter, got %s", got)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if got := pushOffset(jitter, rnd); got < 0 || got >= jitter {
+			t.Fatalf("expected an offset in [0, %s), got %s", jitter, got)
+		}
+	}
+}
+
+func TestPushLoop(t *testing.T) {
+	const (
+		jitter   = 100 * time.Millisecond
+		interval = 50 * time.Millisecond
+		slack    = 20 * time.Millisecond
+	)
+	offset := pushOffset(jitter, rand.New(rand.NewSource(42)))
+	p := &recordingPusher{}
+	start := time.Now()
+	pushLoop(p, start, interval, offset, 3)
+
+	if len(p.times) != 3 {
+		t.Fatalf("expected 3 pushes, got %d", len(p.times))
+	}
+	for i, at := range p.times {
+		// Every push keeps the offset drawn once, not a new one per cycle.
+		want := offset + time.Duration(i)*interval
+		if got := at.Sub(start); got < want || got > want+slack {
+			t.Errorf("push %d: expected at %s after start, got %s", i, want, got)
+		}
+		if got := at.Sub(start) - time.Duration(i)*interval; got < 0 || got >= jitter+slack {
+			t.Errorf("push %d: expected an offset within the jitter of %s, got %s", i, jitter, got)
+		}
+	}
+}
+
+func TestPushJob(t *testing.T) {
+	var path string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	}))
+	defer gateway.Close()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newHeartbeat())
+	if err := newPusher(gateway.URL, "edge", "", reg).Push(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/metrics/job/edge"; path != want {
+		t.Errorf("expected a push to %s, got %s", want, path)
+	}
+}
+
+func TestPushJobLabel(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer gateway.Close()
+
+	newRegistry := func() *prometheus.Registry {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(newHeartbeat(), newFeaturesInfo(false))
+		return reg
+	}
+	if err := newPusher(gateway.URL, "edge", "tengine_job", newRegistry()).Push(); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := withLabel(newRegistry(), "tengine_job", "edge").Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 2 {
+		t.Fatalf("got %d metric families, want 2", len(mfs))
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			if !hasLabels(m, "tengine_job", "edge") {
+				t.Errorf("%s: got labels %v, want tengine_job=edge", mf.GetName(), m.GetLabel())
+			}
+		}
+	}
+	if _, err := withLabel(newRegistry(), "retry", "edge").Gather(); err == nil {
+		t.Error("expected an error labelling features info with its own label")
+	}
+}
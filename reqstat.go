@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// reqstatFormat is the format of the pages of tengine's reqstat module.
+const reqstatFormat = "reqstat"
+
+// reqstatColumns are the columns of a req_status_show line after its key,
+// e.g. "www.example.com,7936,33840,3,3,3,0,0,0,0,12,0,0,0". The round trip
+// times are in milliseconds. Newer tengine versions append the counts of
+// single status codes, which are ignored.
+var reqstatColumns = []string{
+	"bytes_in", "bytes_out", "conn_total", "req_total",
+	"http_2xx", "http_3xx", "http_4xx", "http_5xx", "http_other_status",
+	"rt", "ups_req", "ups_rt", "ups_tries",
+}
+
+// reqstatZone is the traffic counted for a key of a req_status_zone, in the
+// order of reqstatColumns.
+type reqstatZone struct {
+	key    string
+	counts [13]int64
+}
+
+// parseReqstat parses a req_status_show page, one key per line. Lines that
+// cannot be parsed are reported as errors and left out, as are the lines of
+// a key listed before, which would share its series.
+func parseReqstat(data []byte) ([]reqstatZone, []*parseError) {
+	var (
+		zones []reqstatZone
+		errs  []*parseError
+		seen  = map[string]bool{}
+	)
+	for i, line := range strings.Split(string(data), "\n") {
+		lineno := i + 1
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		cols := strings.Split(line, ",")
+		if len(cols) < len(reqstatColumns)+1 {
+			errs = append(errs, &parseError{lineno, "line", fmt.Errorf("expected at least %d columns, got %d", len(reqstatColumns)+1, len(cols))})
+			continue
+		}
+		z := reqstatZone{key: cols[0]}
+		ok := true
+		for c, name := range reqstatColumns {
+			n, err := strconv.ParseInt(strings.TrimSpace(cols[c+1]), 10, 64)
+			if err != nil {
+				errs = append(errs, &parseError{lineno, name, err})
+				ok = false
+				break
+			}
+			z.counts[c] = n
+		}
+		if !ok {
+			continue
+		}
+		if seen[z.key] {
+			errs = append(errs, &parseError{lineno, "key", fmt.Errorf("key %q listed before", z.key)})
+			continue
+		}
+		seen[z.key] = true
+		zones = append(zones, z)
+	}
+	return zones, errs
+}
+
+// reqstatMetrics exports the zones of the last reqstat page parsed, as
+// nginx_reqstat_* so that they can't clash with the check metrics.
+type reqstatMetrics struct {
+	bytesIn, bytesOut, conns, requests *prometheus.Desc
+	responses                          *prometheus.Desc
+	time, upsRequests, upsTime, tries  *prometheus.Desc
+	zones                              []reqstatZone
+}
+
+func newReqstatMetrics(opts metricOpts) *reqstatMetrics {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return opts.desc(prometheus.Opts{
+			Namespace: namespace,
+			Subsystem: reqstatSubsystem,
+			Name:      name,
+			Help:      help,
+		}, append([]string{"key"}, labels...))
+	}
+	return &reqstatMetrics{
+		bytesIn:     desc("bytes_in_total", "Bytes received from clients."),
+		bytesOut:    desc("bytes_out_total", "Bytes sent to clients."),
+		conns:       desc("connections_total", "Number of client connections."),
+		requests:    desc("requests_total", "Number of client requests."),
+		responses:   desc("responses_total", "Number of responses by status class: 2xx, 3xx, 4xx, 5xx or other.", "code"),
+		time:        desc("request_time_seconds_total", "Time spent serving requests."),
+		upsRequests: desc("upstream_requests_total", "Number of requests proxied to upstreams."),
+		upsTime:     desc("upstream_response_time_seconds_total", "Time spent waiting for upstream responses."),
+		tries:       desc("upstream_tries_total", "Number of tries of upstream servers, retries included."),
+	}
+}
+
+// set makes m export zones, the zones of the last page parsed.
+func (m *reqstatMetrics) set(zones []reqstatZone) {
+	m.zones = zones
+}
+
+func (m *reqstatMetrics) describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{m.bytesIn, m.bytesOut, m.conns, m.requests, m.responses, m.time, m.upsRequests, m.upsTime, m.tries} {
+		ch <- d
+	}
+}
+
+func (m *reqstatMetrics) collect(ch chan<- prometheus.Metric) {
+	counter := func(desc *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, v, labels...)
+	}
+	for _, z := range m.zones {
+		c := z.counts
+		counter(m.bytesIn, float64(c[0]), z.key)
+		counter(m.bytesOut, float64(c[1]), z.key)
+		counter(m.conns, float64(c[2]), z.key)
+		counter(m.requests, float64(c[3]), z.key)
+		for i, code := range []string{"2xx", "3xx", "4xx", "5xx", "other"} {
+			counter(m.responses, float64(c[4+i]), z.key, code)
+		}
+		counter(m.time, float64(c[9])/1000, z.key)
+		counter(m.upsRequests, float64(c[10]), z.key)
+		counter(m.upsTime, float64(c[11])/1000, z.key)
+		counter(m.tries, float64(c[12]), z.key)
+	}
+}
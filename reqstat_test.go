@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+const reqstatPage = `www.example.com,7936,33840,3,5,2,1,1,1,0,120,4,90,6
+api.example.com,100,200,1,1,1,0,0,0,0,3,1,2,1,1,0,0
+api.example.com,1,1,1,1,1,0,0,0,0,1,1,1,1
+bad,1,2
+`
+
+func TestParseReqstat(t *testing.T) {
+	zones, errs := parseReqstat([]byte(reqstatPage))
+	if len(zones) != 2 || zones[0].key != "www.example.com" || zones[1].key != "api.example.com" {
+		t.Fatalf("unexpected zones %+v", zones)
+	}
+	if want := [13]int64{7936, 33840, 3, 5, 2, 1, 1, 1, 0, 120, 4, 90, 6}; zones[0].counts != want {
+		t.Errorf("got counts %v, want %v", zones[0].counts, want)
+	}
+	if zones[1].counts[0] != 100 {
+		t.Errorf("got bytes in %d for the first api.example.com line, want 100", zones[1].counts[0])
+	}
+	if len(errs) != 2 || errs[0].Line != 3 || errs[0].Field != "key" || errs[1].Line != 4 || errs[1].Field != "line" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/log"
+)
+
+// srvDiscovery discovers status targets from a DNS SRV record. The scheme,
+// user info and path of the target URIs are those of template.
+type srvDiscovery struct {
+	record   string
+	template *url.URL
+	lookup   func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+func newSRVDiscovery(record, template string) (*srvDiscovery, error) {
+	u, err := url.Parse(template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scrape URI %q: %s", redactURI(template), err)
+	}
+	return &srvDiscovery{record: record, template: u, lookup: net.LookupSRV}, nil
+}
+
+// resolve returns the URIs of the targets the record currently points to,
+// sorted for a stable order.
+func (d *srvDiscovery) resolve() ([]string, error) {
+	_, addrs, err := d.lookup("", "", d.record)
+	if err != nil {
+		return nil, err
+	}
+	var uris []string
+	for _, a := range addrs {
+		u := *d.template
+		u.Host = net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port)))
+		uris = append(uris, u.String())
+	}
+	sort.Strings(uris)
+	return uris, nil
+}
+
+// NewSRVExporter returns a dynamic MultiExporter scraping the targets d
+// resolves to.
+func NewSRVExporter(d *srvDiscovery) (*MultiExporter, error) {
+	m := newMultiExporter(true)
+	if err := m.discover(d); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// discover replaces the targets of m with those d resolves to.
+func (m *MultiExporter) discover(d *srvDiscovery) error {
+	uris, err := d.resolve()
+	if err != nil {
+		return fmt.Errorf("error resolving SRV record %s: %s", d.record, err)
+	}
+	if len(uris) == 0 {
+		log.Warnf("SRV record %s has no targets", d.record)
+	}
+	return m.setTargets(uris, nil)
+}
+
+// rediscover calls discover every interval, keeping the current targets if
+// resolving fails.
+func (m *MultiExporter) rediscover(d *srvDiscovery, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := m.discover(d); err != nil {
+			log.Errorln(err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSRVDiscovery(t *testing.T) {
+	var targets []*net.SRV
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/status" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(nginxStatus))
+		}))
+		defer server.Close()
+		u, _ := url.Parse(server.URL)
+		port, _ := strconv.Atoi(u.Port())
+		targets = append(targets, &net.SRV{Target: "localhost.", Port: uint16(port)})
+	}
+
+	d, err := newSRVDiscovery("_status._tcp.nginx.example.com", "http://ignored/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lookupErr error
+	d.lookup = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_status._tcp.nginx.example.com" {
+			t.Errorf("unexpected lookup of %q", name)
+		}
+		return "", targets, lookupErr
+	}
+	m, err := NewSRVExporter(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(m)
+
+	check := func(want ...*net.SRV) {
+		t.Helper()
+		mfs := gather(t, reg)
+		if n := len(mfs["nginx_up"].GetMetric()); n != len(want) {
+			t.Errorf("expected %d scraped targets, got %d", len(want), n)
+		}
+		for _, srv := range want {
+			target := net.JoinHostPort("localhost", strconv.Itoa(int(srv.Port)))
+			if v, ok := seriesValue(mfs, "nginx_up", "target", target); !ok || v != 1 {
+				t.Errorf("target %s not scraped", target)
+			}
+		}
+	}
+	check(targets...)
+
+	kept := m.exporterFor(net.JoinHostPort("localhost", strconv.Itoa(int(targets[0].Port))))
+	targets = targets[:1]
+	if err := m.discover(d); err != nil {
+		t.Fatal(err)
+	}
+	check(targets...)
+	if m.targets()[0] != kept {
+		t.Error("exporter of a remaining target was replaced")
+	}
+
+	lookupErr = errors.New("no such host")
+	if err := m.discover(d); err == nil {
+		t.Error("expected an error when the lookup fails")
+	}
+	check(targets...)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stubStatusFormat is the format of the pages of nginx's stub_status module.
+const stubStatusFormat = "stub_status"
+
+// stubStatus is the connection and request counts of a stub_status page:
+//
+//	Active connections: 291
+//	server accepts handled requests
+//	 16630948 16630948 31070465
+//	Reading: 6 Writing: 179 Waiting: 106
+//
+// Tengine may add a request_time column after requests, which is ignored.
+type stubStatus struct {
+	active, accepted, handled, requests int64
+	reading, writing, waiting           int64
+}
+
+// parseStubStatus parses a stub_status page. It is an error for any of its
+// three sections to be missing or malformed.
+func parseStubStatus(data []byte) (stubStatus, []*parseError) {
+	var (
+		s                       stubStatus
+		errs                    []*parseError
+		active, counts, readers bool
+	)
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		var err error
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) == 3 && fields[0] == "Active" && fields[1] == "connections:":
+			s.active, err = strconv.ParseInt(fields[2], 10, 64)
+			active = err == nil
+		case fields[0] == "server" && i+1 < len(lines):
+			// The counts are on the line below their names.
+			i++
+			err = parseInts(strings.Fields(lines[i]), &s.accepted, &s.handled, &s.requests)
+			counts = err == nil
+		case len(fields) == 6 && fields[0] == "Reading:" && fields[2] == "Writing:" && fields[4] == "Waiting:":
+			err = parseInts([]string{fields[1], fields[3], fields[5]}, &s.reading, &s.writing, &s.waiting)
+			readers = err == nil
+		default:
+			err = fmt.Errorf("unexpected line %q", lines[i])
+		}
+		if err != nil {
+			errs = append(errs, &parseError{i + 1, stubStatusFormat, err})
+		}
+	}
+	for _, section := range []struct {
+		name  string
+		found bool
+	}{{"active connections", active}, {"connection and request counts", counts}, {"connection states", readers}} {
+		if !section.found {
+			errs = append(errs, &parseError{len(lines), stubStatusFormat, fmt.Errorf("no %s", section.name)})
+		}
+	}
+	return s, errs
+}
+
+// parseInts parses the first len(values) of fields into values.
+func parseInts(fields []string, values ...*int64) error {
+	if len(fields) < len(values) {
+		return fmt.Errorf("expected %d numbers, got %d", len(values), len(fields))
+	}
+	for i, v := range values {
+		n, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return err
+		}
+		*v = n
+	}
+	return nil
+}
+
+// stubStatusMetrics exports the last stub_status page parsed.
+type stubStatusMetrics struct {
+	active, accepted, handled, requests *prometheus.Desc
+	reading, writing, waiting           *prometheus.Desc
+	last                                *stubStatus // nil before a page parsed.
+}
+
+func newStubStatusMetrics(opts metricOpts) *stubStatusMetrics {
+	desc := func(name, help string) *prometheus.Desc {
+		return opts.desc(prometheus.Opts{Namespace: namespace, Name: name, Help: help}, nil)
+	}
+	return &stubStatusMetrics{
+		active:   desc("connections_active", "Number of active client connections, waiting ones included."),
+		accepted: desc("connections_accepted_total", "Number of accepted client connections."),
+		handled:  desc("connections_handled_total", "Number of handled client connections."),
+		requests: desc("http_requests_total", "Number of client requests."),
+		reading:  desc("connections_reading", "Number of connections whose request header is being read."),
+		writing:  desc("connections_writing", "Number of connections whose response is being written."),
+		waiting:  desc("connections_waiting", "Number of idle client connections waiting for a request."),
+	}
+}
+
+// set makes m export s, or export nothing if the page didn't parse.
+func (m *stubStatusMetrics) set(s stubStatus, ok bool) {
+	m.last = nil
+	if ok {
+		m.last = &s
+	}
+}
+
+func (m *stubStatusMetrics) describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{m.active, m.accepted, m.handled, m.requests, m.reading, m.writing, m.waiting} {
+		ch <- d
+	}
+}
+
+func (m *stubStatusMetrics) collect(ch chan<- prometheus.Metric) {
+	s := m.last
+	if s == nil {
+		return
+	}
+	for _, v := range []struct {
+		desc  *prometheus.Desc
+		typ   prometheus.ValueType
+		value int64
+	}{
+		{m.active, prometheus.GaugeValue, s.active},
+		{m.accepted, prometheus.CounterValue, s.accepted},
+		{m.handled, prometheus.CounterValue, s.handled},
+		{m.requests, prometheus.CounterValue, s.requests},
+		{m.reading, prometheus.GaugeValue, s.reading},
+		{m.writing, prometheus.GaugeValue, s.writing},
+		{m.waiting, prometheus.GaugeValue, s.waiting},
+	} {
+		ch <- prometheus.MustNewConstMetric(v.desc, v.typ, float64(v.value))
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+const stubStatusPage = `Active connections: 291
+server accepts handled requests request_time
+ 16630948 16630946 31070465 11831
+Reading: 6 Writing: 179 Waiting: 106
+`
+
+func TestParseStubStatus(t *testing.T) {
+	s, errs := parseStubStatus([]byte(stubStatusPage))
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	want := stubStatus{active: 291, accepted: 16630948, handled: 16630946, requests: 31070465, reading: 6, writing: 179, waiting: 106}
+	if s != want {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+
+	for _, data := range []string{"Active connections: 1\n", nginxStatus, "Active connections: x\nserver accepts handled requests\n 1 1 1\nReading: 0 Writing: 1 Waiting: 0\n"} {
+		if _, errs := parseStubStatus([]byte(data)); len(errs) == 0 {
+			t.Errorf("expected errors for %q", data)
+		}
+	}
+}
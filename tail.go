@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// clearScreen moves the cursor home and clears the terminal, so that each
+// cycle of tail replaces the previous table.
+const clearScreen = "\033[H\033[2J"
+
+// tail scrapes every target of m each interval and prints the servers as a
+// table to w, for -tail. It stops after cycles cycles, or never if cycles is
+// zero or less.
+func tail(m *MultiExporter, w io.Writer, interval time.Duration, cycles int) {
+	for i := 0; cycles <= 0 || i < cycles; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		fmt.Fprint(w, clearScreen)
+		fmt.Fprintln(w, time.Now().Format(time.RFC3339))
+		for _, e := range m.targets() {
+			printStatus(e, w)
+		}
+	}
+}
+
+// printStatus scrapes e once and prints its servers to w.
+func printStatus(e *Exporter, w io.Writer) {
+	fmt.Fprintf(w, "\n%s\n", redactURI(e.URI))
+	buf, err := e.fetch()
+	if err != nil {
+		fmt.Fprintln(w, "Error:", err)
+		return
+	}
+	e.mutex.RLock()
+	parse, format := e.parse, e.format
+	e.mutex.RUnlock()
+	if parse == nil {
+		putBuffer(buf)
+		fmt.Fprintf(w, "The %s page lists no servers\n", format)
+		return
+	}
+	servers, errs := parse(buf.Bytes(), e.parseWorkers)
+	putBuffer(buf)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "UPSTREAM\tSERVER\tSTATUS\tRISE\tFALL")
+	for _, s := range servers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\n", s.Upstream, s.Name, s.Status, s.Rise, s.Fall)
+	}
+	tw.Flush()
+	if len(errs) > 0 {
+		fmt.Fprintf(w, "%d lines could not be parsed\n", len(errs))
+	}
+}
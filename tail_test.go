@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTail(t *testing.T) {
+	var requests int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 2 {
+			w.Write([]byte(strings.Replace(nginxStatus, "10.1.0.2:80,up,8251,0", "10.1.0.2:80,down,0,3", 1)))
+			return
+		}
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	m, err := NewMultiExporter([]string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	tail(m, &out, 0, 2)
+
+	cycles := strings.Split(out.String(), clearScreen)[1:]
+	if len(cycles) != 2 || requests != 2 {
+		t.Fatalf("expected 2 cycles and requests, got %d and %d:\n%s", len(cycles), requests, out.String())
+	}
+	for i, want := range []string{
+		`us1\s+10\.1\.0\.2:80\s+up\s+8251\s+0\n`,
+		`us1\s+10\.1\.0\.2:80\s+down\s+0\s+3\n`,
+	} {
+		if !regexp.MustCompile(want).MatchString(cycles[i]) {
+			t.Errorf("cycle %d: expected %q in output:\n%s", i, want, cycles[i])
+		}
+		if !strings.Contains(cycles[i], "UPSTREAM  SERVER") {
+			t.Errorf("cycle %d: table header missing:\n%s", i, cycles[i])
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/prometheus/log"
+)
+
+// targetFormats maps the formats a target may declare to the parsers they
+// are read with.
+var targetFormats = map[string]string{
+	"tengine_csv": "csv",
+	"csv":         "csv",
+	"json":        "json",
+	"kv":          "kv",
+	"reqstat":     reqstatFormat,
+	"stub_status": stubStatusFormat,
+}
+
+// parseTargets returns the scrape URIs of a targets file, one per line, and
+// the formats of those declaring one, e.g.
+// "http://10.0.0.1/status format=json"; the others are read in the format
+// of -nginx.format. Empty lines and lines starting with # are ignored.
+func parseTargets(data []byte) ([]string, map[string]string, error) {
+	var uris []string
+	formats := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; sc.Scan(); lineno++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		uri := fields[0]
+		for _, f := range fields[1:] {
+			parts := strings.SplitN(f, "=", 2)
+			if len(parts) != 2 || parts[0] != "format" {
+				return nil, nil, fmt.Errorf("line %d: unknown target option %q", lineno, f)
+			}
+			format, ok := targetFormats[parts[1]]
+			if !ok {
+				return nil, nil, fmt.Errorf("line %d: unsupported format %q, must be tengine_csv, json, kv, reqstat or stub_status", lineno, parts[1])
+			}
+			formats[uri] = format
+		}
+		uris = append(uris, uri)
+	}
+	return uris, formats, nil
+}
+
+// NewFileExporter returns a dynamic MultiExporter scraping the targets
+// listed in the file at path.
+func NewFileExporter(path string) (*MultiExporter, error) {
+	m := newMultiExporter(true)
+	if err := m.loadTargets(path); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// reloadStatus is the result of the last load of the targets file, as
+// served by /-/reload/status on the admin address.
+type reloadStatus struct {
+	Timestamp time.Time `json:"timestamp"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ReloadStatus returns the result of the last load of the targets file, or
+// false if m does not read one.
+func (m *MultiExporter) ReloadStatus() (reloadStatus, bool) {
+	m.reloadMutex.Lock()
+	defer m.reloadMutex.Unlock()
+	if m.lastReload == nil {
+		return reloadStatus{}, false
+	}
+	return *m.lastReload, true
+}
+
+// loadTargets replaces the targets of m with those of the file at path and
+// records the result for ReloadStatus.
+func (m *MultiExporter) loadTargets(path string) error {
+	err := m.readTargets(path)
+	status := &reloadStatus{Timestamp: time.Now(), Success: err == nil}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	m.reloadMutex.Lock()
+	m.lastReload = status
+	m.reloadMutex.Unlock()
+	return err
+}
+
+// readTargets replaces the targets of m with those of the file at path.
+func (m *MultiExporter) readTargets(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading targets file: %s", err)
+	}
+	uris, formats, err := parseTargets(data)
+	if err == nil {
+		err = m.setTargets(uris, formats)
+	}
+	if err != nil {
+		return fmt.Errorf("error in targets file %s: %s", path, err)
+	}
+	m.configHash.Reset()
+	m.configHash.WithLabelValues(fileHash(data)).Set(1)
+	m.configReload.SetToCurrentTime()
+	return nil
+}
+
+// fileHash returns the first 12 hex digits of the SHA-256 of data, enough
+// to tell config versions apart.
+func fileHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// reloadTargets calls loadTargets every interval until stop is closed,
+// keeping the current targets if the file can't be loaded.
+func (m *MultiExporter) reloadTargets(path string, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := m.loadTargets(path); err != nil {
+				log.Errorln(err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
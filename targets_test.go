@@ -0,0 +1,357 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseTargets(t *testing.T) {
+	uris, formats, err := parseTargets([]byte("# status pages\nhttp://a/status\n\n  http://b/status  format=json\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uris) != 2 || uris[0] != "http://a/status" || uris[1] != "http://b/status" {
+		t.Errorf("unexpected targets %q", uris)
+	}
+	if len(formats) != 1 || formats["http://b/status"] != "json" {
+		t.Errorf("unexpected formats %v", formats)
+	}
+
+	for _, data := range []string{"http://a/status format=bogus\n", "http://a/status json\n"} {
+		if _, _, err := parseTargets([]byte(data)); err == nil {
+			t.Errorf("expected an error for %q", data)
+		}
+	}
+}
+
+func TestTargetsFileFormats(t *testing.T) {
+	jsonStatus, err := ioutil.ReadFile("testdata/status.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	}))
+	defer csvServer.Close()
+	jsonServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jsonStatus)
+	}))
+	defer jsonServer.Close()
+
+	dir, err := ioutil.TempDir("", "targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets")
+	data := csvServer.URL + " format=tengine_csv\n" + jsonServer.URL + " format=json\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(m)
+	mfs := gather(t, reg)
+	csvTarget := strings.TrimPrefix(csvServer.URL, "http://")
+	jsonTarget := strings.TrimPrefix(jsonServer.URL, "http://")
+	if v, _ := seriesValue(mfs, "nginx_raise", "target", csvTarget, "upstream", "us2", "name", "10.1.0.5:80"); v != 7918 {
+		t.Errorf("csv target: got raise %v, want 7918", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_raise", "target", jsonTarget, "upstream", "us2", "name", "10.1.0.3:80"); v != 12 {
+		t.Errorf("json target: got raise %v, want 12", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_exporter_scrape_errors_total", "target", csvTarget, "collector", "json"); v != 0 {
+		t.Errorf("csv target: got %v json errors, want 0", v)
+	}
+}
+
+func TestTargetsFileModuleFormats(t *testing.T) {
+	stubServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(stubStatusPage))
+	}))
+	defer stubServer.Close()
+	reqstatServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(reqstatPage))
+	}))
+	defer reqstatServer.Close()
+
+	dir, err := ioutil.TempDir("", "targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets")
+	data := stubServer.URL + " format=stub_status\n" + reqstatServer.URL + " format=reqstat\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(m)
+	mfs := gather(t, reg)
+	stubTarget := strings.TrimPrefix(stubServer.URL, "http://")
+	reqstatTarget := strings.TrimPrefix(reqstatServer.URL, "http://")
+	if v, _ := seriesValue(mfs, "nginx_connections_active", "target", stubTarget); v != 291 {
+		t.Errorf("stub_status target: got %v active connections, want 291", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_http_requests_total", "target", stubTarget); v != 31070465 {
+		t.Errorf("stub_status target: got %v requests, want 31070465", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_reqstat_responses_total", "target", reqstatTarget, "key", "www.example.com", "code", "4xx"); v != 1 {
+		t.Errorf("reqstat target: got %v 4xx responses, want 1", v)
+	}
+	if v, _ := seriesValue(mfs, "nginx_reqstat_request_time_seconds_total", "target", reqstatTarget, "key", "www.example.com"); v != 0.12 {
+		t.Errorf("reqstat target: got request time %v, want 0.12", v)
+	}
+	for _, target := range []string{stubTarget, reqstatTarget} {
+		if v, _ := seriesValue(mfs, "nginx_up", "target", target); v != 1 {
+			t.Errorf("%s: got up %v, want 1", target, v)
+		}
+	}
+	if _, ok := seriesValue(mfs, "nginx_raise"); ok {
+		t.Error("expected no check metrics without a check status page")
+	}
+}
+
+func TestTargetsFileReload(t *testing.T) {
+	var servers []*httptest.Server
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(nginxStatus))
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	dir, err := ioutil.TempDir("", "targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets")
+	if err := ioutil.WriteFile(path, []byte(servers[0].URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(m)
+	scraped := func() map[string]bool {
+		targets := map[string]bool{}
+		for _, metric := range gather(t, reg)["nginx_up"].GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == "target" {
+					targets["http://"+l.GetValue()] = true
+				}
+			}
+		}
+		return targets
+	}
+	if targets := scraped(); len(targets) != 1 || !targets[servers[0].URL] {
+		t.Fatalf("expected only the first target, got %v", targets)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go m.reloadTargets(path, 10*time.Millisecond, stop)
+	if err := ioutil.WriteFile(path, []byte(servers[1].URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		targets := scraped()
+		if len(targets) == 1 && targets[servers[1].URL] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected only the second target after reload, got %v", targets)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A broken file keeps the current targets.
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat(servers[1].URL+"\n", 2)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.loadTargets(path); err == nil {
+		t.Error("expected an error for duplicate targets")
+	}
+	if targets := scraped(); !targets[servers[1].URL] {
+		t.Errorf("targets changed by a broken file: %v", targets)
+	}
+}
+
+func TestRemovedTargetSeries(t *testing.T) {
+	var servers []*httptest.Server
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(nginxStatus))
+		}))
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	dir, err := ioutil.TempDir("", "targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets")
+	if err := ioutil.WriteFile(path, []byte(servers[0].URL+"\n"+servers[1].URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make the second target panic, for a series labelled with its URI.
+	m.exporters[1].parse = func(data []byte, workers int) ([]ServerStatus, []*parseError) {
+		panic("parser bug")
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(m)
+	removed := strings.TrimPrefix(servers[1].URL, "http://")
+	series := func() int {
+		n := 0
+		for _, mf := range gather(t, reg) {
+			for _, metric := range mf.GetMetric() {
+				if hasLabels(metric, "target", removed) || hasLabels(metric, "uri", servers[1].URL) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	if n := series(); n == 0 {
+		t.Fatal("expected series of the second target before its removal")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(servers[0].URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.loadTargets(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := series(); n != 0 {
+		t.Errorf("expected no series of the removed target, got %d", n)
+	}
+}
+
+func TestConfigFileHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets")
+	hash := func(m *MultiExporter) string {
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(m)
+		mf := gather(t, reg)["nginx_exporter_config_file_hash_info"]
+		if len(mf.GetMetric()) != 1 {
+			t.Fatalf("expected one config hash, got %v", mf)
+		}
+		return mf.GetMetric()[0].GetLabel()[0].GetValue()
+	}
+
+	if err := ioutil.WriteFile(path, []byte("# no targets yet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := hash(m)
+	if len(before) != 12 || before != fileHash([]byte("# no targets yet\n")) {
+		t.Errorf("unexpected hash %q", before)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("# still none\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.loadTargets(path); err != nil {
+		t.Fatal(err)
+	}
+	if after := hash(m); after == before {
+		t.Errorf("hash %q unchanged after the file changed", after)
+	}
+}
+
+func TestConfigLastReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets")
+	if err := ioutil.WriteFile(path, []byte("# no targets yet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(m)
+	lastReload := func() float64 {
+		v, ok := seriesValue(gather(t, reg), "nginx_exporter_config_last_reload_timestamp_seconds")
+		if !ok {
+			t.Fatal("nginx_exporter_config_last_reload_timestamp_seconds missing")
+		}
+		return v
+	}
+	before := lastReload()
+	if start := float64(processStart.Unix()); before < start {
+		t.Errorf("got last reload %v, want no earlier than the process start %v", before, start)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := m.loadTargets(path); err != nil {
+		t.Fatal(err)
+	}
+	after := lastReload()
+	if after <= before {
+		t.Errorf("expected the last reload to advance past %v, got %v", before, after)
+	}
+
+	// A failed load keeps the time of the last successful one.
+	if err := ioutil.WriteFile(path, []byte("http://a\nhttp://a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.loadTargets(path); err == nil {
+		t.Fatal("expected an error for duplicate targets")
+	}
+	if v := lastReload(); v != after {
+		t.Errorf("expected the last reload to stay at %v after a failed load, got %v", after, v)
+	}
+
+	static, err := NewMultiExporter([]string{"http://localhost/status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metric dto.Metric
+	if err := static.configReload.Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if v := metric.GetGauge().GetValue(); v != float64(processStart.UnixNano())/1e9 {
+		t.Errorf("expected the process start without a targets file, got %v", v)
+	}
+}
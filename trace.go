@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"time"
+)
+
+// scrapeTrace records the timings of a single status request.
+type scrapeTrace struct {
+	start    time.Time // When the request was sent.
+	dnsStart time.Time
+	dnsDone  time.Time
+	tlsStart time.Time
+	tlsDone  time.Time
+	resumed  bool // Whether the handshake resumed a TLS session.
+}
+
+func (t *scrapeTrace) clientTrace() *httptrace.ClientTrace {
+	t.start = time.Now()
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.dnsDone = time.Now() },
+		TLSHandshakeStart: func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.tlsDone = time.Now()
+			t.resumed = err == nil && state.DidResume
+		},
+	}
+}
+
+// dnsLookup returns the time spent resolving the target host, zero if no
+// lookup took place (IP targets or reused connections).
+func (t *scrapeTrace) dnsLookup() time.Duration {
+	if t.dnsStart.IsZero() || t.dnsDone.Before(t.dnsStart) {
+		return 0
+	}
+	return t.dnsDone.Sub(t.dnsStart)
+}
+
+// tlsHandshakeFraction returns the fraction of the request, from sending it
+// until end, spent in the TLS handshake, zero if no handshake took place
+// (plain http or reused connections).
+func (t *scrapeTrace) tlsHandshakeFraction(end time.Time) float64 {
+	total := end.Sub(t.start)
+	if t.tlsStart.IsZero() || t.tlsDone.Before(t.tlsStart) || total <= 0 {
+		return 0
+	}
+	if f := t.tlsDone.Sub(t.tlsStart).Seconds() / total.Seconds(); f < 1 {
+		return f
+	}
+	return 1
+}
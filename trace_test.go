@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDNSLookupTrace(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	uri := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	e := NewExporter(uri)
+	e.trace = true
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	v, ok := seriesValue(gather(t, reg), "nginx_exporter_dns_lookup_seconds")
+	if !ok {
+		t.Fatal("nginx_exporter_dns_lookup_seconds missing with tracing enabled")
+	}
+	if v < 0 {
+		t.Errorf("got negative DNS lookup time %v", v)
+	}
+
+	e.trace = false
+	if _, ok := seriesValue(gather(t, reg), "nginx_exporter_dns_lookup_seconds"); ok {
+		t.Error("nginx_exporter_dns_lookup_seconds exported with tracing disabled")
+	}
+}
+
+func TestTLSHandshakeFraction(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.trace = true
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	// The first scrape opens the connection, with a handshake.
+	v, ok := seriesValue(gather(t, reg), "nginx_exporter_tls_handshake_fraction")
+	if !ok {
+		t.Fatal("nginx_exporter_tls_handshake_fraction missing with tracing enabled")
+	}
+	if v <= 0 || v > 1 {
+		t.Errorf("got TLS handshake fraction %v, want in (0, 1]", v)
+	}
+
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	e = NewExporter(plain.URL)
+	e.trace = true
+	reg = prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	if _, ok := seriesValue(gather(t, reg), "nginx_exporter_tls_handshake_fraction"); ok {
+		t.Error("nginx_exporter_tls_handshake_fraction exported for a plain http target")
+	}
+}
+
+func TestTLSResumed(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.trace = true
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+
+	if v, ok := seriesValue(gather(t, reg), "nginx_exporter_tls_resumed_total"); !ok || v != 0 {
+		t.Fatalf("first scrape: got %v resumed sessions (exported %t), want 0", v, ok)
+	}
+	// Reconnect, resuming the session of the first connection.
+	e.client.CloseIdleConnections()
+	if v, _ := seriesValue(gather(t, reg), "nginx_exporter_tls_resumed_total"); v != 1 {
+		t.Errorf("second scrape: got %v resumed sessions, want 1", v)
+	}
+	// A reused connection takes no handshake.
+	if v, _ := seriesValue(gather(t, reg), "nginx_exporter_tls_resumed_total"); v != 1 {
+		t.Errorf("scrape over a reused connection: got %v resumed sessions, want 1", v)
+	}
+}
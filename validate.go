@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// validateFile parses the saved status body at path, in the -nginx.format
+// format, printing the parsed servers and any parse errors to w. It returns
+// the process exit code: 0 if every line parsed, 1 otherwise.
+func validateFile(path string, w io.Writer) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(w, "Error reading status file:", err)
+		return 1
+	}
+
+	parse, ok := parsers[*statusFormat]
+	if !ok {
+		fmt.Fprintf(w, "Error: -nginx.format %s lists no servers to validate\n", *statusFormat)
+		return 1
+	}
+	servers, errs := parse(data, 1)
+	for _, s := range servers {
+		fmt.Fprintf(w, "upstream=%s name=%s status=%s rise=%d fall=%d type=%s\n",
+			s.Upstream, s.Name, s.Status, s.Rise, s.Fall, s.Type)
+	}
+	for _, err := range errs {
+		fmt.Fprintln(w, "Error:", err)
+	}
+	fmt.Fprintf(w, "%d servers parsed, %d errors\n", len(servers), len(errs))
+	if len(errs) > 0 {
+		return 1
+	}
+	return 0
+}
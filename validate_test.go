@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidateFile(t *testing.T) {
+	var out bytes.Buffer
+	if code := validateFile("testdata/status.csv", &out); code != 0 {
+		t.Errorf("expected exit code 0, got %d:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "upstream=us1 name=10.1.0.2:80 status=down rise=0 fall=3 type=tcp") {
+		t.Errorf("parsed server missing from output:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "3 servers parsed, 0 errors") {
+		t.Errorf("unexpected summary:\n%s", out.String())
+	}
+
+	out.Reset()
+	if code := validateFile("testdata/status_bad.csv", &out); code != 1 {
+		t.Errorf("expected exit code 1, got %d:\n%s", code, out.String())
+	}
+	for _, want := range []string{"line 2: error parsing raise", "line 3: error parsing line", "1 servers parsed, 2 errors"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in output:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if code := validateFile("testdata/missing.csv", &out); code != 1 {
+		t.Errorf("expected exit code 1 for missing file, got %d", code)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/log"
+)
+
+// metricsHandler returns the handler serving the metrics of g. With
+// created, counters get _created samples when OpenMetrics is negotiated.
+func metricsHandler(g prometheus.Gatherer, created bool) http.Handler {
+	if !created {
+		return promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	}
+	return promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		EnableOpenMetrics:                   true,
+		EnableOpenMetricsTextCreatedSamples: true,
+	})
+}
+
+// probeTimeoutOffset is subtracted from Prometheus's scrape timeout so that
+// a probe responds, if only with nginx_up 0, before Prometheus gives up.
+const probeTimeoutOffset = 500 * time.Millisecond
+
+// probeHandler scrapes the status URI given by the target parameter of each
+// request and serves its metrics. The scrape is cancelled after timeout, or
+// earlier if the X-Prometheus-Scrape-Timeout-Seconds header asks for it.
+//
+// Targets are chosen by the caller, so with allowed set, only those whose
+// host:port it matches in full are probed, and only those are sent the
+// credentials of authorize. Without it, any target is probed without
+// credentials, which would otherwise go to whatever host was asked for.
+func probeHandler(timeout time.Duration, authorize authorizer, allowed *regexp.Regexp) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			http.Error(w, fmt.Sprintf("invalid target %q", target), http.StatusBadRequest)
+			return
+		}
+		if allowed != nil && !matchesFully(allowed, u.Host) {
+			log.Debugf("Rejecting probe of %s", redactURI(target))
+			http.Error(w, "target not allowed", http.StatusForbidden)
+			return
+		}
+		d := timeout
+		if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+			secs, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid X-Prometheus-Scrape-Timeout-Seconds %q", v), http.StatusBadRequest)
+				return
+			}
+			if t := time.Duration(secs*float64(time.Second)) - probeTimeoutOffset; t > 0 && (d <= 0 || t < d) {
+				d = t
+			}
+		}
+
+		e := NewExporter(target)
+		e.client.Timeout = d
+		if allowed != nil {
+			e.authorize = authorize
+		}
+		defer e.client.CloseIdleConnections()
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(e)
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// matchesFully reports whether re matches all of s.
+func matchesFully(re *regexp.Regexp, s string) bool {
+	loc := re.FindStringIndex(s)
+	return loc != nil && loc[0] == 0 && loc[1] == len(s)
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs, which must hold at
+// least one so that a set but blank allowlist doesn't allow everyone.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %s", c, err)
+		}
+		nets = append(nets, n)
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("no CIDR in %q", s)
+	}
+	return nets, nil
+}
+
+// clientIP returns the address of the client that issued r. The last
+// X-Forwarded-For entry, the one appended by the trusted proxy, is used
+// instead of RemoteAddr when trustXFF is set; the entries before it come from
+// the client and could be forged.
+func clientIP(r *http.Request, trustXFF bool) net.IP {
+	if trustXFF {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			entries := strings.Split(values[len(values)-1], ",")
+			return net.ParseIP(strings.TrimSpace(entries[len(entries)-1]))
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ipAllowlist wraps next, answering 403 to clients outside of nets.
+func ipAllowlist(nets []*net.IPNet, trustXFF bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trustXFF)
+		if ip != nil {
+			for _, n := range nets {
+				if n.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		log.Debugf("Rejecting metrics request from %s", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
+
+// adminHandler returns the handler of the admin endpoints:
+//
+//	GET    /-/freeze  reports whether scraping is frozen
+//	POST   /-/freeze  freezes scraping
+//	DELETE /-/freeze  resumes scraping
+//	GET    /-/reload/status
+//	                  reports the last load of -nginx.targets-file as json
+//	GET    /-/inventory?target=host
+//	                  lists the servers of the last scrape as json
+//	GET    /debug/last-body?target=host
+//	                  returns the last status body, if -web.debug-last-body-bytes is set
+func adminHandler(e *MultiExporter) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/-/freeze", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "POST", "PUT":
+			e.SetFrozen(true)
+			log.Infoln("Scraping frozen")
+		case "DELETE":
+			e.SetFrozen(false)
+			log.Infoln("Scraping resumed")
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintf(w, "frozen: %t\n", e.Frozen())
+	})
+	mux.HandleFunc("/-/reset-parse-duration-max", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		e.ResetParseDurationMax()
+		log.Infoln("Maximum parse duration reset")
+	})
+	mux.HandleFunc("/-/reload/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status, ok := e.ReloadStatus()
+		if !ok {
+			http.Error(w, "No targets file loaded", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	mux.HandleFunc("/-/inventory", func(w http.ResponseWriter, r *http.Request) {
+		target := e.exporterFor(r.URL.Query().Get("target"))
+		if target == nil {
+			http.Error(w, "Unknown target", http.StatusNotFound)
+			return
+		}
+		servers, ok := target.Inventory()
+		if !ok {
+			http.Error(w, "No status scraped yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(servers)
+	})
+	if *lastBodyBytes > 0 {
+		mux.HandleFunc("/debug/last-body", func(w http.ResponseWriter, r *http.Request) {
+			target := e.exporterFor(r.URL.Query().Get("target"))
+			if target == nil {
+				http.Error(w, "Unknown target", http.StatusNotFound)
+				return
+			}
+			body, ok := target.LastBody()
+			if !ok {
+				http.Error(w, "No status body scraped yet", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write(body)
+		})
+	}
+	return mux
+}
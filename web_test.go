@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestIPAllowlist(t *testing.T) {
+	nets, err := parseCIDRs("10.0.0.0/8, 192.168.1.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	tests := []struct {
+		remoteAddr string
+		xff        string
+		trustXFF   bool
+		want       int
+	}{
+		{"10.1.2.3:4567", "", false, http.StatusOK},
+		{"192.168.1.1:4567", "", false, http.StatusOK},
+		{"192.168.1.2:4567", "", false, http.StatusForbidden},
+		{"10.1.2.3:4567", "172.16.0.1", true, http.StatusForbidden},
+		{"172.16.0.1:4567", "172.16.0.9, 10.1.2.3", true, http.StatusOK},
+		// The client prepended an allowed address to its own.
+		{"172.16.0.1:4567", "10.1.2.3, 172.16.0.9", true, http.StatusForbidden},
+		{"172.16.0.1:4567", "10.1.2.3", false, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		rec := httptest.NewRecorder()
+		ipAllowlist(nets, tt.trustXFF, ok).ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s (xff %q, trust %v): got status %d, want %d", tt.remoteAddr, tt.xff, tt.trustXFF, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestParseCIDRsInvalid(t *testing.T) {
+	if _, err := parseCIDRs("10.0.0.0/8,not-a-cidr"); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+	for _, s := range []string{",", " ", " , "} {
+		if _, err := parseCIDRs(s); err == nil {
+			t.Errorf("%q: expected error for a list without CIDRs", s)
+		}
+	}
+}
+
+func TestAdminFreeze(t *testing.T) {
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e, err := NewMultiExporter([]string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	admin := adminHandler(e)
+
+	gather(t, reg)
+	if requests != 1 {
+		t.Fatalf("expected 1 request before freezing, got %d", requests)
+	}
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("POST", "/-/freeze", nil))
+	if !strings.Contains(rec.Body.String(), "frozen: true") {
+		t.Fatalf("unexpected freeze response %q", rec.Body.String())
+	}
+
+	for i := 0; i < 3; i++ {
+		mfs := gather(t, reg)
+		if v, _ := seriesValue(mfs, "nginx_exporter_frozen"); v != 1 {
+			t.Errorf("got nginx_exporter_frozen %v, want 1", v)
+		}
+		if v, _ := seriesValue(mfs, "nginx_raise", "upstream", "us1", "name", "10.1.0.1:80"); v != 8247 {
+			t.Errorf("got cached raise %v, want 8247", v)
+		}
+		if v, _ := seriesValue(mfs, "nginx_up"); v != 1 {
+			t.Errorf("got nginx_up %v while frozen, want 1", v)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expected no requests while frozen, got %d", requests-1)
+	}
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("DELETE", "/-/freeze", nil))
+	if v, _ := seriesValue(gather(t, reg), "nginx_exporter_frozen"); v != 0 {
+		t.Errorf("got nginx_exporter_frozen %v after resuming, want 0", v)
+	}
+	if requests != 2 {
+		t.Errorf("expected scraping to resume, got %d requests", requests)
+	}
+}
+
+func TestAdminLastBody(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	*lastBodyBytes = 40
+	defer func() { *lastBodyBytes = 0 }()
+	e, err := NewMultiExporter([]string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	admin := adminHandler(e)
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/last-body", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 before the first scrape, got %d", rec.Code)
+	}
+
+	gather(t, reg)
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/last-body", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if want := nginxStatus[:40]; rec.Body.String() != want {
+		t.Errorf("got body %q, want %q", rec.Body.String(), want)
+	}
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/last-body?target=unknown:80", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown target, got %d", rec.Code)
+	}
+}
+
+func TestLastBodyRedacted(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0,us1,10.1.0.1:80,up,8247,0,tcp,0\n1,us1,10.1.0.2:80,up,8251,0,tcp,0\n"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	*lastBodyBytes = 52
+	defer func() { *lastBodyBytes = 0 }()
+	e := NewExporter(server.URL)
+	e.redactBody = regexp.MustCompile(`10\.1\.0\.\d+`)
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	gather(t, reg)
+
+	body, ok := e.LastBody()
+	if !ok {
+		t.Fatal("no body kept after a scrape")
+	}
+	if want := "0,us1,[REDACTED]:80,up,8247,0,tcp,0\n1,us1,[REDACTED]"; string(body) != want {
+		t.Errorf("got body %q, want %q", body, want)
+	}
+}
+
+func TestAdminResetParseDurationMax(t *testing.T) {
+	body := nginxStatus
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e, err := NewMultiExporter([]string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	admin := adminHandler(e)
+	parseMax := func() float64 {
+		v, _ := seriesValue(gather(t, reg), "nginx_exporter_parse_duration_max_seconds")
+		return v
+	}
+
+	small := parseMax()
+	if small <= 0 {
+		t.Fatalf("expected a positive maximum parse duration, got %v", small)
+	}
+	body = strings.Repeat(nginxStatus, 20000)
+	large := parseMax()
+	if large <= small {
+		t.Errorf("expected the maximum to advance past %v on a larger body, got %v", small, large)
+	}
+	body = nginxStatus
+	if v := parseMax(); v != large {
+		t.Errorf("expected the maximum to stay at %v on a smaller body, got %v", large, v)
+	}
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("POST", "/-/reset-parse-duration-max", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if v := parseMax(); v >= large {
+		t.Errorf("expected the maximum to restart below %v after a reset, got %v", large, v)
+	}
+}
+
+func TestAdminReloadStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets")
+	if err := ioutil.WriteFile(path, []byte(server.URL+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := adminHandler(e)
+	status := func() reloadStatus {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest("GET", "/-/reload/status", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		var s reloadStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if s := status(); !s.Success || s.Error != "" || s.Timestamp.IsZero() {
+		t.Errorf("expected the initial load to succeed, got %+v", s)
+	}
+
+	before := time.Now()
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat(server.URL+"\n", 2)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.loadTargets(path); err == nil {
+		t.Fatal("expected an error for duplicate targets")
+	}
+	s := status()
+	if s.Success || !strings.Contains(s.Error, "duplicate") || s.Timestamp.Before(before) {
+		t.Errorf("expected the failed reload, got %+v", s)
+	}
+
+	m, err := NewMultiExporter([]string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	adminHandler(m).ServeHTTP(rec, httptest.NewRequest("GET", "/-/reload/status", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a targets file, got %d", rec.Code)
+	}
+}
+
+func TestAdminInventory(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatusWithReasons))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e, err := NewMultiExporter([]string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := adminHandler(e)
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/-/inventory", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 before the first scrape, got %d", rec.Code)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	gather(t, reg)
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest("GET", "/-/inventory", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var servers []inventoryServer
+	if err := json.Unmarshal(rec.Body.Bytes(), &servers); err != nil {
+		t.Fatal(err)
+	}
+	// Servers down are listed along with those up.
+	want := []inventoryServer{
+		{"us1", "10.1.0.1:80", "tcp"},
+		{"us1", "10.1.0.2:80", "tcp"},
+		{"us2", "10.1.0.3:80", "http"},
+		{"us2", "10.1.0.4:80", "http"},
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("got inventory %+v, want %+v", servers, want)
+	}
+}
+
+func TestInventoryAsParsed(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0,US1,Web.example.com:80,up,1,0,tcp,0\n1,US1,Web.example.com:80,down,0,1,http,0\n"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	e := NewExporter(server.URL)
+	e.lowercase, e.stripSuffix = true, ".example.com:80"
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	gather(t, reg)
+	// The inventory lists tengine's names and both check types, which the
+	// metrics transform and merge.
+	want := []inventoryServer{
+		{"US1", "Web.example.com:80", "http"},
+		{"US1", "Web.example.com:80", "tcp"},
+	}
+	if servers, ok := e.Inventory(); !ok || !reflect.DeepEqual(servers, want) {
+		t.Errorf("got inventory %+v, want %+v", servers, want)
+	}
+}
+
+func TestMetricsHandlerCreated(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(server.URL), newHeartbeat())
+
+	for _, tt := range []struct {
+		created bool
+		want    bool
+	}{
+		{false, false},
+		{true, true},
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+		rec := httptest.NewRecorder()
+		metricsHandler(reg, tt.created).ServeHTTP(rec, req)
+
+		body := rec.Body.String()
+		for _, line := range []string{"nginx_exporter_scrape_retries_created", "nginx_exporter_heartbeat_created"} {
+			if got := strings.Contains(body, line); got != tt.want {
+				t.Errorf("created=%v: %s present: %v, want %v\n%s", tt.created, line, got, tt.want, body)
+			}
+		}
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+			w.Write([]byte(nginxStatus))
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	probe := probeHandler(10*time.Second, nil, nil)
+
+	rec := httptest.NewRecorder()
+	probe.ServeHTTP(rec, httptest.NewRequest("GET", "/probe", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a target, got %d", rec.Code)
+	}
+
+	// 0.7s minus the offset leaves 0.2s for the scrape.
+	req := httptest.NewRequest("GET", "/probe?target="+backend.URL, nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.7")
+	rec = httptest.NewRecorder()
+	start := time.Now()
+	probe.ServeHTTP(rec, req)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("probe took %s despite the scrape timeout", elapsed)
+	}
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "nginx_up 0") {
+		t.Errorf("expected nginx_up 0 from a timed out probe, got %d:\n%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestProbeAllowedTargets(t *testing.T) {
+	var authorized []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorized = append(authorized, r.Header.Get("Authorization"))
+		w.Write([]byte(nginxStatus))
+	}))
+	defer backend.Close()
+	authorize := func(req *http.Request) error {
+		req.Header.Set("Authorization", "Negotiate token")
+		return nil
+	}
+	host := strings.TrimPrefix(backend.URL, "http://")
+
+	for _, tt := range []struct {
+		allowed  *regexp.Regexp
+		target   string
+		want     int
+		wantAuth string
+	}{
+		{nil, backend.URL, http.StatusOK, ""},
+		{regexp.MustCompile(regexp.QuoteMeta(host)), backend.URL + "/status", http.StatusOK, "Negotiate token"},
+		// Only a full match of the host allows the target.
+		{regexp.MustCompile("127"), backend.URL, http.StatusForbidden, ""},
+		{regexp.MustCompile(regexp.QuoteMeta(host)), "http://evil.test/?" + host, http.StatusForbidden, ""},
+		{nil, "not a url", http.StatusBadRequest, ""},
+	} {
+		authorized = nil
+		rec := httptest.NewRecorder()
+		probeHandler(time.Second, authorize, tt.allowed).ServeHTTP(rec, httptest.NewRequest("GET", "/probe?target="+url.QueryEscape(tt.target), nil))
+		if rec.Code != tt.want {
+			t.Errorf("allowed %v, target %s: got status %d, want %d", tt.allowed, tt.target, rec.Code, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			if len(authorized) != 0 {
+				t.Errorf("allowed %v, target %s: rejected target scraped", tt.allowed, tt.target)
+			}
+		} else if len(authorized) != 1 || authorized[0] != tt.wantAuth {
+			t.Errorf("allowed %v, target %s: got authorization %q, want %q", tt.allowed, tt.target, authorized, tt.wantAuth)
+		}
+	}
+}
+
+func TestProbeParallel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(nginxStatus))
+	}))
+	defer backend.Close()
+	probe := probeHandler(time.Second, nil, nil)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 8)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			probe.ServeHTTP(rec, httptest.NewRequest("GET", "/probe?target="+backend.URL, nil))
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("probe %d: got status %d, want 200", i, code)
+		}
+	}
+}